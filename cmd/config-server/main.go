@@ -0,0 +1,95 @@
+// Command config-server serves encrypted remote config to daemons,
+// e.g. config-server --instance default with config_default.json:
+//
+//	{"listen": ":8443", "dir": "/etc/config-server/configs", "keys": ["/etc/config-server/key.pem"]}
+//
+// Configs are read from <dir>/<key>.{json,yaml,toml}, by default the key is
+// /<project>/<appID>/<version>/<instance>.
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/virzz/daemon/v2"
+	"github.com/virzz/daemon/v2/server"
+)
+
+var (
+	Version = "dev"
+	Commit  = "dev"
+)
+
+type Config struct {
+	Listen  string   `json:"listen" default:":8443" validate:"required" description:"Address to listen on"`
+	Dir     string   `json:"dir" default:"/etc/config-server/configs" validate:"required" description:"Directory of the configs"`
+	Keys    []string `json:"keys" validate:"required" description:"PEM private key files, the first is the current one"`
+	TLSCert string   `json:"tls_cert" description:"TLS certificate file, plain HTTP if empty"`
+	TLSKey  string   `json:"tls_key" description:"TLS key file"`
+	Prefix  string   `json:"prefix" description:"Path the daemons' remote endpoint points to, trimmed from the keys"`
+}
+
+var C = &Config{}
+
+func action(cmd *cobra.Command, _ []string) error {
+	keys := make([]*rsa.PrivateKey, 0, len(C.Keys))
+	for _, fn := range C.Keys {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		key, err := server.ParsePrivateKey(buf)
+		if err != nil {
+			return errors.New(fn + ": " + err.Error())
+		}
+		keys = append(keys, key)
+	}
+	handler := server.New(server.DirStore{Dir: C.Dir}, keys...)
+	handler.Prefix = C.Prefix
+	srv := &http.Server{
+		Addr:              C.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() {
+		if C.TLSCert != "" {
+			errCh <- srv.ListenAndServeTLS(C.TLSCert, C.TLSKey)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+func main() {
+	d, err := daemon.New("config-server",
+		daemon.WithAppID("com.virzz.config-server"),
+		daemon.WithDescription("Remote config server"),
+		daemon.WithVersion(Version, Commit),
+		daemon.WithConfig(C),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	d.Execute(action)
+}
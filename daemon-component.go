@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// Component is one of several services run by the same binary, e.g. an API, a worker and a scheduler.
+// Each component is installed as <name>-<component>@.service and run with --component <component>.
+type Component struct {
+	Name        string
+	Description string
+	// Action runs the component, with run-all it returns once the context of cmd is done
+	Action ActionFunc
+	// Config is unmarshalled from the <Name> section of the config, optional
+	Config any
+
+	configInit reflect.Value
+}
+
+// AddComponent registers a component of the default daemon
+func AddComponent(c Component) error { return Default().AddComponent(c) }
+
+// WithComponent registers a component, see AddComponent
+func WithComponent(c Component) Option {
+	return func(d *Daemon) error { return d.AddComponent(c) }
+}
+
+// AddComponent registers a component. Once a daemon has components, its units are the units
+// of the components, and the action passed to Execute only runs without --component.
+func (d *Daemon) AddComponent(c Component) error {
+	if !envPattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid component name %q, expected lowercase letters, digits, - and _", c.Name)
+	}
+	if c.Action == nil {
+		return fmt.Errorf("component %s: Action is required", c.Name)
+	}
+	if c.Config != nil {
+		if t := reflect.TypeOf(c.Config); t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("component %s: Config must be a pointer to a struct, got %T", c.Name, c.Config)
+		}
+	}
+	if d.component(c.Name) != nil {
+		return fmt.Errorf("component %s already registered", c.Name)
+	}
+	d.components = append(d.components, &c)
+	d.systemd.components = d.components
+	if d.created {
+		d.addFlags()
+	}
+	return nil
+}
+
+func (d *Daemon) addComponentFlags() {
+	d.root.PersistentFlags().StringP("component", "C", "", "Component to run or manage, all components if not set")
+	d.root.AddCommand(d.runAllCommand())
+}
+
+func (d *Daemon) component(name string) *Component {
+	for _, c := range d.components {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) componentNames() []string {
+	names := make([]string, 0, len(d.components))
+	for _, c := range d.components {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// run dispatches to the action of the component given by --component, or to action,
+// or to the workers if there is no action
+func (d *Daemon) run(action ActionFunc) ActionFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(d.components) > 0 {
+			name, _ := cmd.Flags().GetString("component")
+			if name != "" {
+				c := d.component(name)
+				if c == nil {
+					return fmt.Errorf("unknown component %q, expected one of: %s", name, strings.Join(d.componentNames(), ", "))
+				}
+				return d.lifecycle(cmd, args, c.Action, false)
+			}
+			if action == nil && d.supervisor.Len() == 0 {
+				return fmt.Errorf("no component given, use --component with one of: %s, or run-all", strings.Join(d.componentNames(), ", "))
+			}
+		}
+		if action == nil {
+			if d.supervisor.Len() > 0 {
+				return d.lifecycle(cmd, args, nil, true)
+			}
+			return cmd.Help()
+		}
+		return d.lifecycle(cmd, args, action, false)
+	}
+}
+
+// runAllCommand runs every component concurrently in one process, meant for development
+func (d *Daemon) runAllCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "run-all",
+		Short: "Run all components in one process, for development",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := d.start(cmd); err != nil {
+				return err
+			}
+			return d.lifecycle(cmd, args, d.runAll, false)
+		},
+	}
+}
+
+// runAll runs every component concurrently and joins their errors. The context of cmd is
+// cancelled once a component fails or on SIGINT or SIGTERM, the components return on it.
+func (d *Daemon) runAll(cmd *cobra.Command, args []string) error {
+	parent := cmd.Context()
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		stop()
+		cmd.SetContext(parent)
+	}()
+	cmd.SetContext(ctx)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, c := range slices.Clone(d.components) {
+		wg.Add(1)
+		go func(c *Component) {
+			defer wg.Done()
+			d.logger.Info("Running component " + c.Name)
+			if err := c.Action(cmd, args); err != nil {
+				d.logger.Error("Component "+c.Name+" failed", "err", err.Error())
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+				mu.Unlock()
+				cancel()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
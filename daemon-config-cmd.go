@@ -0,0 +1,320 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func (d *Daemon) configCommand(rootCmd *cobra.Command) {
+	var configCmd = &cobra.Command{
+		GroupID: "config",
+		Use:     "config",
+		Short:   "Inspect and manage the configuration",
+	}
+
+	var showCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := d.loadConfig(cmd); err != nil {
+				return err
+			}
+			reveal, _ := cmd.Flags().GetBool("reveal")
+			if sources, _ := cmd.Flags().GetBool("sources"); sources {
+				keys := d.v.AllKeys()
+				slices.Sort(keys)
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+				for _, key := range keys {
+					var value any = d.v.Get(key)
+					if !reveal && isSecret(d.config, key) && value != "" {
+						value = redacted
+					}
+					fmt.Fprintf(w, "%s\t%v\t%s\n", key, value, d.configSource(cmd, key))
+				}
+				return w.Flush()
+			}
+			settings := d.v.AllSettings()
+			if !reveal {
+				settings = redactConfig(d.config, settings, "")
+			}
+			return printJSON(settings)
+		},
+	}
+
+	var getCmd = &cobra.Command{
+		Use:   "get <key>",
+		Short: "Print the effective value of a key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := d.loadConfig(cmd); err != nil {
+				return err
+			}
+			if !d.v.IsSet(args[0]) {
+				return fmt.Errorf("key %s is not set", args[0])
+			}
+			value := d.v.Get(args[0])
+			if s, ok := value.(string); ok {
+				fmt.Println(s)
+				return nil
+			}
+			return printJSON(value)
+		},
+	}
+
+	var setCmd = &cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Write a value to the config file of the instance, or of its profile with --env",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			instance, _ := cmd.Flags().GetString("instance")
+			env, err := d.profile(cmd)
+			if err != nil {
+				return err
+			}
+			fn, _ := cmd.Flags().GetString("config")
+			if fn == "" {
+				if fn, err = d.findConfig(instanceConfig(instance, env)); err != nil {
+					fn = filepath.Join(d.configSearchPaths()[0], instanceConfig(instance, env)+".json")
+				}
+			}
+			old, err := os.ReadFile(fn)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			t, err := configType(fn)
+			if err != nil {
+				return err
+			}
+			v := viper.New()
+			v.SetConfigType(t)
+			if old != nil {
+				buf, err := d.readConfigData(cmd, fn)
+				if err != nil {
+					return err
+				}
+				if err = v.ReadConfig(bytes.NewReader(buf)); err != nil {
+					return err
+				}
+			}
+			var value any = args[1]
+			if json.Unmarshal([]byte(args[1]), &value) != nil {
+				value = args[1]
+			}
+			v.Set(args[0], value)
+			buf, err := encodeConfig(v, t)
+			if err != nil {
+				return err
+			}
+			perm := os.FileMode(0644)
+			if isEncrypted(fn) {
+				key, err := d.configKey(cmd)
+				if err != nil {
+					return err
+				}
+				if buf, err = encryptConfig(key, buf); err != nil {
+					return err
+				}
+				perm = 0600
+			}
+			if err = os.WriteFile(fn, buf, perm); err != nil {
+				return err
+			}
+			// Roll back values the registered config rejects
+			if err = d.loadConfig(cmd); err != nil {
+				if old != nil {
+					os.WriteFile(fn, old, perm)
+				} else {
+					os.Remove(fn)
+				}
+				return err
+			}
+			d.logger.Info("Saved " + args[0] + " to " + fn)
+			return nil
+		},
+	}
+
+	var validateCmd = &cobra.Command{
+		Use:   "validate [file]",
+		Short: "Check a config file, or the effective config, against the registered config",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if d.config == nil {
+				return errors.New("no config registered")
+			}
+			if len(args) == 0 {
+				if err := d.loadConfig(cmd); err != nil {
+					return err
+				}
+				fmt.Println("OK")
+				return nil
+			}
+			env, err := d.profile(cmd)
+			if err != nil {
+				return err
+			}
+			values, err := d.readConfigFile(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			if err = checkConfig(d.config, values, env); err != nil {
+				return err
+			}
+			fmt.Println("OK " + args[0])
+			return nil
+		},
+	}
+
+	var schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the registered config",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if d.config == nil {
+				return errors.New("no config registered")
+			}
+			schema := ConfigSchema(d.config)
+			schema["title"] = d.systemd.Name
+			return printJSON(schema)
+		},
+	}
+
+	var initCmd = &cobra.Command{
+		Use:   "init",
+		Short: "Create the config file of an instance interactively",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if d.config == nil {
+				return errors.New("no config registered")
+			}
+			instance, _ := cmd.Flags().GetString("instance")
+			env, err := d.profile(cmd)
+			if err != nil {
+				return err
+			}
+			fn, _ := cmd.Flags().GetString("output")
+			if fn == "" {
+				fn = filepath.Join(d.configSearchPaths()[0], instanceConfig(instance, env)+".json")
+			}
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				if _, err := os.Stat(fn); err == nil {
+					return fmt.Errorf("%s already exists, use --force to overwrite", fn)
+				}
+			}
+			values, err := promptConfig(d.config, env)
+			if err != nil {
+				return err
+			}
+			if err = checkConfig(d.config, values, env); err != nil {
+				return err
+			}
+			buf, err := marshalConfig(values)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+				return err
+			}
+			if err = os.WriteFile(fn, buf, 0600); err != nil {
+				return err
+			}
+			d.logger.Info("Saved config to " + fn)
+			return nil
+		},
+	}
+
+	var encryptCmd = &cobra.Command{
+		Use:   "encrypt <file>",
+		Short: "Encrypt a config file with the config key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if isEncrypted(args[0]) {
+				return fmt.Errorf("%s is already encrypted", args[0])
+			}
+			if _, err := d.readConfigFile(cmd, args[0]); err != nil {
+				return err
+			}
+			key, err := d.configKey(cmd)
+			if err != nil {
+				return err
+			}
+			buf, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			if buf, err = encryptConfig(key, buf); err != nil {
+				return err
+			}
+			fn, _ := cmd.Flags().GetString("output")
+			if fn == "" {
+				fn = args[0] + encryptedSuffix
+			}
+			if err = os.WriteFile(fn, buf, 0600); err != nil {
+				return err
+			}
+			if remove, _ := cmd.Flags().GetBool("remove"); remove {
+				if err = os.Remove(args[0]); err != nil {
+					return err
+				}
+			}
+			d.logger.Info("Encrypted " + args[0] + " to " + fn)
+			return nil
+		},
+	}
+
+	var decryptCmd = &cobra.Command{
+		Use:   "decrypt <file.enc>",
+		Short: "Decrypt a config file with the config key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !isEncrypted(args[0]) {
+				return fmt.Errorf("%s is not an encrypted config file", args[0])
+			}
+			buf, err := d.readConfigData(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			fn, _ := cmd.Flags().GetString("output")
+			if fn == "-" {
+				_, err = os.Stdout.Write(buf)
+				return err
+			}
+			if fn == "" {
+				fn = strings.TrimSuffix(args[0], encryptedSuffix)
+			}
+			if err = os.WriteFile(fn, buf, 0600); err != nil {
+				return err
+			}
+			d.logger.Info("Decrypted " + args[0] + " to " + fn)
+			return nil
+		},
+	}
+
+	rootCmd.AddGroup(&cobra.Group{ID: "config", Title: "Config commands"})
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(showCmd, getCmd, setCmd, validateCmd, schemaCmd, initCmd, encryptCmd, decryptCmd)
+	showCmd.Flags().Bool("sources", false, "Show where each effective key comes from")
+	showCmd.Flags().Bool("reveal", false, "Show secrets instead of redacting them")
+	initCmd.Flags().StringP("output", "o", "", "Write the config to this file instead of config_<instance>[.<env>].json")
+	initCmd.Flags().BoolP("force", "f", false, "Overwrite an existing config file")
+	encryptCmd.Flags().StringP("output", "o", "", "Write the encrypted config to this file instead of <file>.enc")
+	encryptCmd.Flags().Bool("remove", false, "Remove the plain config file after encrypting it")
+	decryptCmd.Flags().StringP("output", "o", "", "Write the plain config to this file, - for stdout")
+}
+
+func printJSON(v any) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+)
+
+// parseField converts user input to a value of the type of a config field
+func parseField(t reflect.Type, input string) (reflect.Value, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	v := reflect.New(t).Elem()
+	if input == "" {
+		return v, nil
+	}
+	if t == durationType {
+		d, err := time.ParseDuration(input)
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(int64(d))
+		return v, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(input)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(input)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(input, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("expected an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(input, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("expected a positive integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(input, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("expected a number")
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		for _, part := range strings.Split(input, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			item, err := parseField(t.Elem(), part)
+			if err != nil {
+				return v, err
+			}
+			v = reflect.Append(v, item)
+		}
+	default:
+		return v, fmt.Errorf("%s fields are not supported, edit the file instead", t.Kind())
+	}
+	return v, nil
+}
+
+// promptConfig asks for every field of the config type, using the `description` tag
+// as help, the `default` tag as the suggested value and the `validate` tag to check input
+func promptConfig(v any, env string) (map[string]any, error) {
+	values := make(map[string]any)
+	defaults := configDefaults(v, env)
+	for _, f := range configFields(reflect.TypeOf(v), "") {
+		label := f.Key
+		if desc := f.Field.Tag.Get("description"); desc != "" {
+			label += " (" + desc + ")"
+		}
+		def := ""
+		if d, ok := lookupConfig(defaults, f.Key); ok {
+			def = fmt.Sprint(d)
+		}
+		tag := f.Field.Tag.Get("validate")
+		ft := f.Field.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		var items []string
+		for _, rule := range strings.Split(tag, ",") {
+			if name, arg, _ := strings.Cut(rule, "="); name == "oneof" {
+				items = strings.Fields(arg)
+			}
+		}
+		if ft.Kind() == reflect.Bool {
+			items = []string{"true", "false"}
+		}
+
+		var input string
+		var err error
+		if len(items) > 0 {
+			sel := promptui.Select{Label: label, Items: items, CursorPos: max(slices.Index(items, def), 0)}
+			_, input, err = sel.Run()
+		} else {
+			prompt := promptui.Prompt{
+				Label:   label,
+				Default: def,
+				Validate: func(s string) error {
+					fv, err := parseField(ft, s)
+					if err != nil {
+						return err
+					}
+					return validateField(tag, fv)
+				},
+			}
+			if isSecret(v, f.Key) {
+				prompt.Mask = '*'
+			}
+			input, err = prompt.Run()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if input == "" {
+			continue
+		}
+		fv, err := parseField(ft, input)
+		if err != nil {
+			return nil, err
+		}
+		if ft == durationType {
+			setConfig(values, f.Key, input)
+		} else {
+			setConfig(values, f.Key, fv.Interface())
+		}
+	}
+	return values, nil
+}
+
+func marshalConfig(values map[string]any) ([]byte, error) {
+	buf, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"maps"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// ConfigSchema generates a JSON Schema of a config type from its json,
+// default, description, secret and validate struct tags
+func ConfigSchema(v any) map[string]any {
+	schema := typeSchema(reflect.TypeOf(v))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == durationType:
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			embedded := typeSchema(f.Type)
+			if sub, ok := embedded["properties"].(map[string]any); ok {
+				maps.Copy(props, sub)
+				if req, ok := embedded["required"].([]string); ok {
+					required = append(required, req...)
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = strings.ToLower(name)
+		prop := typeSchema(f.Type)
+		if desc := f.Tag.Get("description"); desc != "" {
+			prop["description"] = desc
+		}
+		if def, ok := f.Tag.Lookup("default"); ok {
+			prop["default"] = schemaValue(f.Type, def)
+		}
+		if f.Tag.Get("secret") == "true" {
+			prop["writeOnly"] = true
+		}
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			switch rule {
+			case "required":
+				required = append(required, name)
+			case "min", "max":
+				n, err := strconv.ParseFloat(arg, 64)
+				if err != nil {
+					continue
+				}
+				key := map[string]string{"min": "minimum", "max": "maximum"}[rule]
+				switch prop["type"] {
+				case "string":
+					key = map[string]string{"min": "minLength", "max": "maxLength"}[rule]
+				case "array":
+					key = map[string]string{"min": "minItems", "max": "maxItems"}[rule]
+				case "object":
+					key = map[string]string{"min": "minProperties", "max": "maxProperties"}[rule]
+				}
+				prop[key] = n
+			case "oneof":
+				values := make([]any, 0)
+				for _, v := range strings.Fields(arg) {
+					values = append(values, schemaValue(f.Type, v))
+				}
+				prop["enum"] = values
+			case "url":
+				prop["format"] = "uri"
+			case "duration":
+				prop["pattern"] = durationPattern
+			}
+		}
+		props[name] = prop
+	}
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaValue converts a struct tag value to the JSON type of the field
+func schemaValue(t reflect.Type, v string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == durationType {
+		return v
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return v
+}
@@ -0,0 +1,173 @@
+package daemon
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Validator is implemented by config types checking themselves after each load
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is a validation failure of a single config key
+type FieldError struct {
+	Key string
+	Err error
+}
+
+func (e *FieldError) Error() string { return e.Key + ": " + e.Err.Error() }
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// ConfigError reports all validation failures of a config
+type ConfigError []error
+
+func (e ConfigError) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return "invalid config:\n  " + strings.Join(lines, "\n  ")
+}
+
+func (e ConfigError) Unwrap() []error { return e }
+
+// ValidateConfig checks the `validate` struct tags of v, e.g.
+// `validate:"required,min=1,max=65535"`, and calls Validate if v implements Validator.
+// Supported rules are required, omitempty, min, max, oneof, url and duration.
+func ValidateConfig(v any) error {
+	rv := reflect.ValueOf(v)
+	var errs ConfigError
+	for _, f := range configFields(rv.Type(), "") {
+		tag := f.Field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if err := validateField(tag, fieldValue(rv, f.Index)); err != nil {
+			errs = append(errs, &FieldError{f.Key, err})
+		}
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkConfig validates settings on top of the struct tag defaults against the config type of cfg
+func checkConfig(cfg any, values map[string]any, env string) error {
+	v := viper.New()
+	for key, value := range flattenConfig(configDefaults(cfg, env), "") {
+		v.SetDefault(key, value)
+	}
+	v.MergeConfigMap(values)
+	c := reflect.New(reflect.TypeOf(cfg).Elem())
+	if err := v.Unmarshal(c.Interface(), unmarshalConfig); err != nil {
+		return err
+	}
+	return ValidateConfig(c.Interface())
+}
+
+// validateField checks a value against the rules of a validate tag
+func validateField(tag string, v reflect.Value) error {
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name == "" {
+			continue
+		}
+		if name == "omitempty" {
+			if v.IsZero() {
+				return nil
+			}
+			continue
+		}
+		if err := checkRule(name, arg, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldValue follows index through nested structs, nil pointers yield zero values
+func fieldValue(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		for v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v = reflect.Zero(v.Type().Elem())
+			} else {
+				v = v.Elem()
+			}
+		}
+		v = v.Field(i)
+	}
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func checkRule(name, arg string, v reflect.Value) error {
+	switch name {
+	case "required":
+		if v.IsZero() {
+			return fmt.Errorf("is required")
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s rule %q", name, arg)
+		}
+		n, unit := 0.0, ""
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+			n, unit = float64(v.Len()), " in length"
+		default:
+			return fmt.Errorf("%s is not supported for %s", name, v.Kind())
+		}
+		if name == "min" && n < limit {
+			return fmt.Errorf("must be at least %s%s", arg, unit)
+		}
+		if name == "max" && n > limit {
+			return fmt.Errorf("must be at most %s%s", arg, unit)
+		}
+	case "oneof":
+		values := strings.Fields(arg)
+		if !slices.Contains(values, fmt.Sprint(v.Interface())) {
+			return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+		}
+	case "url":
+		u, err := url.Parse(v.String())
+		if v.Kind() != reflect.String || err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("must be an absolute URL")
+		}
+	case "duration":
+		if v.Type() == durationType {
+			return nil
+		}
+		if _, err := time.ParseDuration(v.String()); v.Kind() != reflect.String || err != nil {
+			return fmt.Errorf("must be a duration such as 30s or 5m")
+		}
+	default:
+		return fmt.Errorf("unknown validation rule %q", name)
+	}
+	return nil
+}
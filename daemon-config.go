@@ -0,0 +1,612 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configExts are the supported config file extensions in lookup order
+var configExts = []string{"json", "yaml", "yml", "toml", "hcl", "env"}
+
+// SetConfigPaths replaces the directories searched for config files of the default daemon.
+// The default is the working directory, $XDG_CONFIG_HOME/<name>/ and /etc/<name>/.
+func SetConfigPaths(paths ...string) { Default().SetConfigPaths(paths...) }
+
+func (d *Daemon) SetConfigPaths(paths ...string) { d.configPaths = paths }
+
+func (d *Daemon) configSearchPaths() []string {
+	if len(d.configPaths) > 0 {
+		return d.configPaths
+	}
+	name := d.systemd.Name
+	paths := []string{"."}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return append(paths, filepath.Join("/etc", name))
+}
+
+// configType returns the viper config type of a config file from its extension,
+// encrypted files are typed by the extension before .enc
+func configType(fn string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(fn, encryptedSuffix)), "."))
+	if !slices.Contains(configExts, ext) {
+		return "", fmt.Errorf("unsupported config file %s, expected one of: %s", fn, strings.Join(configExts, ", "))
+	}
+	if ext == "yml" {
+		return "yaml", nil
+	}
+	return ext, nil
+}
+
+// ConfigNotFoundError lists the locations searched for a config file
+type ConfigNotFoundError struct {
+	Name  string
+	Tried []string
+}
+
+func (e *ConfigNotFoundError) Error() string {
+	return fmt.Sprintf("config file %s not found, tried:\n  %s", e.Name, strings.Join(e.Tried, "\n  "))
+}
+
+// findConfig searches the config paths for base with any supported extension,
+// plain or encrypted
+func (d *Daemon) findConfig(base string) (string, error) {
+	pattern := base + ".{" + strings.Join(configExts, ",") + "}[" + encryptedSuffix + "]"
+	tried := make([]string, 0, 3)
+	for _, dir := range d.configSearchPaths() {
+		for _, ext := range configExts {
+			fn := filepath.Join(dir, base+"."+ext)
+			for _, fn := range []string{fn, fn + encryptedSuffix} {
+				if fi, err := os.Stat(fn); err == nil && !fi.IsDir() {
+					return fn, nil
+				}
+			}
+		}
+		tried = append(tried, filepath.Join(dir, pattern))
+	}
+	return "", &ConfigNotFoundError{Name: base, Tried: tried}
+}
+
+// Config layers in increasing precedence, env and flags are applied by viper on top
+const (
+	layerDefault  = "default"
+	layerBase     = "base"
+	layerInstance = "instance"
+	layerEnv      = "env"
+	layerRemote   = "remote"
+)
+
+type configLayer struct {
+	Name   string
+	Source string
+	Values map[string]any
+}
+
+// loadConfig merges the config layers and unmarshals them into the registered config
+// and the configs of the components.
+// A config failing validation is rejected and the previous one is kept.
+func (d *Daemon) loadConfig(cmd *cobra.Command) error {
+	d.cmd = cmd
+	layers, err := d.readLayers(cmd)
+	if err != nil {
+		return err
+	}
+	return d.useLayers(layers)
+}
+
+// useLayers makes the layers the config, keeping the previous one if they fail validation
+func (d *Daemon) useLayers(layers []configLayer) error {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	if err := d.applyLayers(layers); err != nil {
+		return err
+	}
+	targets, values, err := d.decodeConfigs()
+	if err != nil {
+		if d.layers != nil {
+			d.applyLayers(d.layers)
+		}
+		return err
+	}
+	for i, target := range targets {
+		reflect.ValueOf(target).Elem().Set(values[i].Elem())
+	}
+	d.layers = layers
+	return nil
+}
+
+// decodeConfigs decodes and validates the registered config and the component configs,
+// returning them along with the pointers they are to be stored in
+func (d *Daemon) decodeConfigs() ([]any, []reflect.Value, error) {
+	targets := make([]any, 0, 1+len(d.components))
+	values := make([]reflect.Value, 0, cap(targets))
+	if d.config != nil {
+		cfg, err := decodeConfig(d.v, d.config, &d.configInit)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets, values = append(targets, d.config), append(values, cfg)
+	}
+	for _, c := range d.components {
+		if c.Config == nil {
+			continue
+		}
+		cfg, err := decodeConfig(d.section(c.Name), c.Config, &c.configInit)
+		if err != nil {
+			return nil, nil, fmt.Errorf("component %s: %w", c.Name, err)
+		}
+		targets, values = append(targets, c.Config), append(values, cfg)
+	}
+	return targets, values, nil
+}
+
+// section returns the effective settings below key as a viper instance of their own
+func (d *Daemon) section(key string) *viper.Viper {
+	v := viper.New()
+	if m, ok := d.v.AllSettings()[key].(map[string]any); ok {
+		v.MergeConfigMap(m)
+	}
+	return v
+}
+
+// applyLayers replaces the viper config with the merged layers
+func (d *Daemon) applyLayers(layers []configLayer) error {
+	d.v.SetConfigType("json")
+	if err := d.v.ReadConfig(strings.NewReader("{}")); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if layer.Name == layerDefault {
+			for key, value := range flattenConfig(layer.Values, "") {
+				d.v.SetDefault(key, value)
+			}
+			continue
+		}
+		if err := d.v.MergeConfigMap(layer.Values); err != nil {
+			return err
+		}
+	}
+	// Make every field known to viper so that it can be set from the environment
+	if d.config != nil {
+		for _, f := range configFields(reflect.TypeOf(d.config), "") {
+			d.v.BindEnv(f.Key)
+		}
+	}
+	for _, c := range d.components {
+		if c.Config != nil {
+			for _, f := range configFields(reflect.TypeOf(c.Config), c.Name+".") {
+				d.v.BindEnv(f.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeConfig unmarshals the settings of v into a new value of the type of target and validates it,
+// starting from the values target had before the first load which are kept in init
+func decodeConfig(v *viper.Viper, target any, init *reflect.Value) (reflect.Value, error) {
+	if !init.IsValid() {
+		*init = reflect.New(reflect.TypeOf(target).Elem())
+		init.Elem().Set(reflect.ValueOf(target).Elem())
+	}
+	cfg := reflect.New(init.Type().Elem())
+	cfg.Elem().Set(init.Elem())
+	if err := v.Unmarshal(cfg.Interface(), unmarshalConfig, func(c *mapstructure.DecoderConfig) { c.ZeroFields = true }); err != nil {
+		return cfg, err
+	}
+	return cfg, ValidateConfig(cfg.Interface())
+}
+
+// Reload reads the config of the default daemon again, keeping the current config if the new one is invalid
+func Reload() error { return Default().Reload() }
+
+func (d *Daemon) Reload() error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+	if d.cmd == nil {
+		return fmt.Errorf("config not loaded")
+	}
+	prev := d.layers
+	if err := d.loadConfig(d.cmd); err != nil {
+		d.logger.Error("Failed to reload config, keeping the previous one", "err", err.Error())
+		return err
+	}
+	if err := d.runHooks(d.cmd, HookReload); err != nil {
+		d.logger.Error("Reload hook failed, restoring the previous config", "err", err.Error())
+		if rerr := d.useLayers(prev); rerr != nil {
+			d.logger.Error("Failed to restore the previous config", "err", rerr.Error())
+		}
+		return err
+	}
+	d.logger.Info("Config reloaded")
+	return nil
+}
+
+// ReadConfig runs fn with the config of the default daemon locked against reloads
+func ReadConfig(fn func()) { Default().ReadConfig(fn) }
+
+// ReadConfig runs fn with the config locked against reloads. A reload replaces the registered
+// config structs and the settings of Viper, so code running while the daemon reloads on
+// SIGHUP reads them within fn.
+func (d *Daemon) ReadConfig(fn func()) {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	fn()
+}
+
+// watchReload reloads the config on SIGHUP, which is what ExecReload of the unit sends,
+// until stopReload is called
+func (d *Daemon) watchReload() {
+	d.stopReload()
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				d.Reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	d.unwatch = func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// stopReload stops watching for SIGHUP
+func (d *Daemon) stopReload() {
+	if d.unwatch != nil {
+		d.unwatch()
+		d.unwatch = nil
+	}
+}
+
+// instanceConfig is the base name of the config file of an instance, or of its env profile
+func instanceConfig(instance, env string) string {
+	if env != "" {
+		return "config_" + instance + "." + env
+	}
+	return "config_" + instance
+}
+
+// readLayers reads the struct tag defaults, the shared config, the instance config,
+// the config of its env profile and the remote config
+func (d *Daemon) readLayers(cmd *cobra.Command) ([]configLayer, error) {
+	env, err := d.profile(cmd)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]configLayer, 0, 5)
+	if defaults := d.configDefaults(env); defaults != nil {
+		source := "struct tags"
+		if env != "" {
+			source += " (" + env + ")"
+		}
+		layers = append(layers, configLayer{layerDefault, source, defaults})
+	}
+	found := false
+	if fn, err := d.findConfig("config"); err == nil {
+		values, err := d.readConfigFile(cmd, fn)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{layerBase, fn, values})
+		found = true
+	}
+
+	instance, _ := cmd.Flags().GetString("instance")
+	fn, _ := cmd.Flags().GetString("config")
+	var notFound error
+	if fn == "" {
+		fn, notFound = d.findConfig("config_" + instance)
+	}
+	if fn != "" {
+		values, err := d.readConfigFile(cmd, fn)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{layerInstance, fn, values})
+		found = true
+	}
+	if custom, _ := cmd.Flags().GetString("config"); custom == "" && env != "" {
+		if fn, err := d.findConfig(instanceConfig(instance, env)); err == nil {
+			values, err := d.readConfigFile(cmd, fn)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, configLayer{layerEnv, fn, values})
+			found = true
+		}
+	}
+
+	if d.remoteConfig {
+		layer, err := d.readRemote(cmd, instance, env)
+		if err != nil {
+			return nil, err
+		}
+		if layer != nil {
+			layers = append(layers, *layer)
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, notFound
+	}
+	for _, layer := range layers {
+		if err := resolveSecrets(layer.Values, ""); err != nil {
+			return nil, fmt.Errorf("%s config: %w", layer.Name, err)
+		}
+	}
+	return layers, nil
+}
+
+func (d *Daemon) readConfigFile(cmd *cobra.Command, fn string) (map[string]any, error) {
+	t, err := configType(fn)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := d.readConfigData(cmd, fn)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseConfig(buf, t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return values, nil
+}
+
+// parseConfig decodes config of the given viper config type into nested settings
+func parseConfig(buf []byte, t string) (map[string]any, error) {
+	v := viper.New()
+	v.SetConfigType(t)
+	if err := v.ReadConfig(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	return v.AllSettings(), nil
+}
+
+// readConfigData returns the content of a config file, decrypting encrypted ones
+func (d *Daemon) readConfigData(cmd *cobra.Command, fn string) ([]byte, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil || !isEncrypted(fn) {
+		return buf, err
+	}
+	key, err := d.configKey(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = decryptConfig(key, buf); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return buf, nil
+}
+
+// encodeConfig renders the settings of v in the given config type
+func encodeConfig(v *viper.Viper, t string) ([]byte, error) {
+	fs := afero.NewMemMapFs()
+	v.SetFs(fs)
+	if err := v.WriteConfigAs("/config." + t); err != nil {
+		return nil, err
+	}
+	return afero.ReadFile(fs, "/config."+t)
+}
+
+// flattenConfig returns the leaf values of nested settings keyed by their dotted path
+func flattenConfig(m map[string]any, prefix string) map[string]any {
+	flat := make(map[string]any)
+	for k, v := range m {
+		key := strings.ToLower(prefix + k)
+		if sub, ok := v.(map[string]any); ok {
+			maps.Copy(flat, flattenConfig(sub, key+"."))
+			continue
+		}
+		flat[key] = v
+	}
+	return flat
+}
+
+// configField is a leaf field of the registered config type
+type configField struct {
+	Key   string
+	Field reflect.StructField
+	Index []int
+}
+
+// configFields lists the leaf fields of a config struct keyed the way they are unmarshalled
+func configFields(t reflect.Type, prefix string) []configField {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = strings.ToLower(name)
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}) {
+			sub := prefix
+			if !f.Anonymous || f.Tag.Get("json") != "" {
+				sub += name + "."
+			}
+			for _, c := range configFields(ft, sub) {
+				c.Index = append([]int{i}, c.Index...)
+				fields = append(fields, c)
+			}
+			continue
+		}
+		fields = append(fields, configField{Key: prefix + name, Field: f, Index: []int{i}})
+	}
+	return fields
+}
+
+// configDefaults collects the `default` struct tags of the config type as nested settings,
+// a `default_<env>` tag takes precedence for the env profile
+func configDefaults(v any, env string) map[string]any {
+	values := make(map[string]any)
+	for _, f := range configFields(reflect.TypeOf(v), "") {
+		value, ok := f.Field.Tag.Lookup("default_" + env)
+		if !ok || env == "" {
+			value, ok = f.Field.Tag.Lookup("default")
+		}
+		if !ok {
+			continue
+		}
+		setConfig(values, f.Key, value)
+	}
+	return values
+}
+
+// configDefaults collects the defaults of the registered config and of the component configs
+// below their section, nil if there are no configs
+func (d *Daemon) configDefaults(env string) map[string]any {
+	var values map[string]any
+	if d.config != nil {
+		values = configDefaults(d.config, env)
+	}
+	for _, c := range d.components {
+		if c.Config == nil {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]any)
+		}
+		for key, value := range flattenConfig(configDefaults(c.Config, env), "") {
+			setConfig(values, c.Name+"."+key, value)
+		}
+	}
+	return values
+}
+
+// setConfig sets the value of a dotted key in nested settings
+func setConfig(m map[string]any, key string, value any) {
+	parts := strings.Split(key, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := m[p].(map[string]any)
+		if !ok {
+			sub = make(map[string]any)
+			m[p] = sub
+		}
+		m = sub
+	}
+	m[parts[len(parts)-1]] = value
+}
+
+// lookupConfig returns the value of a dotted key in nested settings
+func lookupConfig(m map[string]any, key string) (any, bool) {
+	parts := strings.Split(key, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := m[p].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		m = sub
+	}
+	v, ok := m[parts[len(parts)-1]]
+	return v, ok
+}
+
+var secretWords = []string{"password", "passwd", "secret", "token", "apikey", "api_key", "private_key", "privatekey", "credential"}
+
+// isSecret reports whether key holds a secret, either tagged `secret:"true"` in the config type or by its name
+func isSecret(cfg any, key string) bool {
+	if cfg != nil {
+		for _, f := range configFields(reflect.TypeOf(cfg), "") {
+			if f.Key == key && f.Field.Tag.Get("secret") == "true" {
+				return true
+			}
+		}
+	}
+	name := strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	for _, word := range secretWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+const redacted = "******"
+
+// redactConfig returns a copy of the nested settings with secrets masked
+func redactConfig(cfg any, m map[string]any, prefix string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		key := prefix + k
+		if isSecret(cfg, key) && v != nil && v != "" {
+			out[k] = redacted
+			continue
+		}
+		if sub, ok := v.(map[string]any); ok {
+			out[k] = redactConfig(cfg, sub, key+".")
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// envName returns the environment variable viper reads key from
+func (d *Daemon) envName(key string) string {
+	return envReplacer.Replace(strings.ToUpper(d.root.Use + "_" + key))
+}
+
+// envReplacer maps config keys to environment variable names. Both "."
+// and "-" become "_", so the flag key "remote-keys" is read from
+// <APP>_REMOTE_KEYS: shells cannot export names containing "-".
+var envReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// configSource describes where the effective value of key comes from
+func (d *Daemon) configSource(cmd *cobra.Command, key string) string {
+	if f := cmd.Flags().Lookup(key); f != nil && f.Changed {
+		return "flag --" + f.Name
+	}
+	env := d.envName(key)
+	if _, ok := os.LookupEnv(env); ok {
+		return "env " + env
+	}
+	for i := len(d.layers) - 1; i >= 0; i-- {
+		if _, ok := lookupConfig(d.layers[i].Values, key); ok {
+			return d.layers[i].Name + " " + d.layers[i].Source
+		}
+	}
+	if f := cmd.Flags().Lookup(key); f != nil {
+		return "flag default"
+	}
+	return "unset"
+}
@@ -0,0 +1,327 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestFindConfig(t *testing.T) {
+	etc, local := t.TempDir(), t.TempDir()
+	d := newDaemon(viper.New())
+	d.systemd.Name = "myservice"
+	d.SetConfigPaths(local, etc)
+
+	_, err := d.findConfig("config_default")
+	var notFound *ConfigNotFoundError
+	if !errors.As(err, &notFound) || len(notFound.Tried) != 2 || !strings.Contains(err.Error(), filepath.Join(etc, "config_default.{json,yaml,yml,toml,hcl,env}")) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(etc, "config_default.yaml"), []byte("a: 1\n"), 0644)
+	fn, err := d.findConfig("config_default")
+	if err != nil || fn != filepath.Join(etc, "config_default.yaml") {
+		t.Fatalf("expected yaml config in %s, got %s %v", etc, fn, err)
+	}
+	os.WriteFile(filepath.Join(local, "config_default.toml"), []byte("a = 1\n"), 0644)
+	if fn, _ = d.findConfig("config_default"); fn != filepath.Join(local, "config_default.toml") {
+		t.Errorf("expected local config to take precedence, got %s", fn)
+	}
+}
+
+func TestConfigType(t *testing.T) {
+	for fn, want := range map[string]string{
+		"config.json": "json", "config.YML": "yaml", "/etc/x/config.toml": "toml", "config.hcl": "hcl", ".env": "env",
+	} {
+		if got, err := configType(fn); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s %v", fn, want, got, err)
+		}
+	}
+	if _, err := configType("config.xml"); err == nil {
+		t.Error("expected error for unsupported extension")
+	}
+}
+
+type testConfig struct {
+	Name string `json:"name" default:"myservice"`
+	Port int    `json:"port" default:"8080"`
+	DB   struct {
+		Host     string `json:"host" default:"localhost"`
+		Password string `json:"password"`
+	} `json:"db"`
+	Ignored string `json:"-"`
+}
+
+func TestConfigDefaults(t *testing.T) {
+	keys := []string{}
+	for _, f := range configFields(reflect.TypeOf(&testConfig{}), "") {
+		keys = append(keys, f.Key)
+	}
+	if want := []string{"name", "port", "db.host", "db.password"}; !slices.Equal(keys, want) {
+		t.Errorf("expected fields %v, got %v", want, keys)
+	}
+	want := map[string]any{"name": "myservice", "port": "8080", "db.host": "localhost"}
+	if got := flattenConfig(configDefaults(&testConfig{}, ""), ""); !maps.Equal(got, want) {
+		t.Errorf("expected defaults %v, got %v", want, got)
+	}
+}
+
+type validatedConfig struct {
+	Mode     string        `json:"mode" validate:"required,oneof=dev prod"`
+	Port     int           `json:"port" validate:"min=1,max=65535"`
+	Endpoint string        `json:"endpoint" validate:"omitempty,url"`
+	Timeout  string        `json:"timeout" validate:"omitempty,duration"`
+	Interval time.Duration `json:"interval" validate:"duration"`
+	Tags     []string      `json:"tags" validate:"max=2"`
+}
+
+func (c *validatedConfig) Validate() error {
+	if c.Mode == "prod" && c.Endpoint == "" {
+		return errors.New("endpoint is required in prod mode")
+	}
+	return nil
+}
+
+func TestValidateConfig(t *testing.T) {
+	ok := &validatedConfig{Mode: "dev", Port: 80, Endpoint: "https://example.com", Timeout: "5s"}
+	if err := ValidateConfig(ok); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	bad := &validatedConfig{Mode: "prod", Port: 70000, Endpoint: "", Timeout: "soon", Tags: []string{"a", "b", "c"}}
+	err := ValidateConfig(bad)
+	var cerr ConfigError
+	if !errors.As(err, &cerr) || len(cerr) != 4 {
+		t.Fatalf("expected 4 errors, got %v", err)
+	}
+	for _, want := range []string{"port: must be at most 65535", "timeout: must be a duration", "tags: must be at most 2 in length", "endpoint is required in prod mode"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestReloadKeepsValidConfig(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config_default.json")
+	os.WriteFile(fn, []byte(`{"mode":"dev","port":8080}`), 0644)
+
+	cfg := &validatedConfig{}
+	d := newDaemon(viper.New())
+	d.logger = slog.Default()
+	d.SetConfigPaths(dir)
+	d.RegisterConfig(cfg)
+	cmd := &cobra.Command{}
+	cmd.Flags().String("instance", "default", "")
+	cmd.Flags().String("config", "", "")
+	if err := d.loadConfig(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 8080 {
+		t.Fatalf("expected port 8080, got %d", cfg.Port)
+	}
+
+	os.WriteFile(fn, []byte(`{"mode":"staging","port":9090}`), 0644)
+	if err := d.Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if cfg.Port != 8080 || d.v.GetInt("port") != 8080 {
+		t.Errorf("expected previous config to be kept, got %d / %d", cfg.Port, d.v.GetInt("port"))
+	}
+
+	os.WriteFile(fn, []byte(`{"mode":"dev","port":9090}`), 0644)
+	if err := d.Reload(); err != nil || cfg.Port != 9090 {
+		t.Errorf("expected reload to apply port 9090, got %d %v", cfg.Port, err)
+	}
+	// Readers holding the lock see either config, never a partly replaced one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.ReadConfig(func() {
+				if cfg.Port != d.v.GetInt("port") {
+					t.Errorf("config %d and settings %d out of sync", cfg.Port, d.v.GetInt("port"))
+				}
+			})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		d.Reload()
+	}
+	<-done
+
+	// A failing reload hook restores the config it was given
+	d.AddHook(HookReload, func(*cobra.Command) error {
+		if cfg.Port == 7070 {
+			return errors.New("port in use")
+		}
+		return nil
+	})
+	os.WriteFile(fn, []byte(`{"mode":"dev","port":7070}`), 0644)
+	if err := d.Reload(); err == nil || cfg.Port != 9090 || d.v.GetInt("port") != 9090 {
+		t.Errorf("expected the previous config after a failing reload hook, got %d %v", cfg.Port, err)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema(&validatedConfig{})
+	props := schema["properties"].(map[string]any)
+	if req := schema["required"].([]string); !slices.Equal(req, []string{"mode"}) {
+		t.Errorf("expected mode to be required, got %v", req)
+	}
+	if enum := props["mode"].(map[string]any)["enum"]; !reflect.DeepEqual(enum, []any{"dev", "prod"}) {
+		t.Errorf("unexpected enum %v", enum)
+	}
+	if port := props["port"].(map[string]any); port["type"] != "integer" || port["maximum"] != 65535.0 {
+		t.Errorf("unexpected port schema %v", port)
+	}
+	if tags := props["tags"].(map[string]any); tags["type"] != "array" || tags["maxItems"] != 2.0 {
+		t.Errorf("unexpected tags schema %v", tags)
+	}
+	if d := ConfigSchema(&testConfig{})["properties"].(map[string]any)["port"].(map[string]any)["default"]; d != int64(8080) {
+		t.Errorf("expected typed default 8080, got %#v", d)
+	}
+}
+
+func TestParseField(t *testing.T) {
+	for _, c := range []struct {
+		t     reflect.Type
+		input string
+		want  any
+	}{
+		{reflect.TypeOf(0), "42", 42},
+		{reflect.TypeOf(uint16(0)), "8080", uint16(8080)},
+		{reflect.TypeOf(true), "true", true},
+		{reflect.TypeOf(time.Duration(0)), "1m30s", 90 * time.Second},
+		{reflect.TypeOf([]string{}), "a, b,,c", []string{"a", "b", "c"}},
+		{reflect.TypeOf(0.0), "", 0.0},
+	} {
+		v, err := parseField(c.t, c.input)
+		if err != nil || !reflect.DeepEqual(v.Interface(), c.want) {
+			t.Errorf("%s %q: expected %v, got %v %v", c.t, c.input, c.want, v, err)
+		}
+	}
+	if _, err := parseField(reflect.TypeOf(0), "many"); err == nil {
+		t.Error("expected error for invalid integer")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "db"), []byte("s3cret\n"), 0600)
+	t.Setenv("TEST_API_TOKEN", "t0ken")
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	values := map[string]any{
+		"db":    map[string]any{"password": "file://" + filepath.Join(dir, "db"), "host": "localhost"},
+		"token": "env://TEST_API_TOKEN",
+		"cred":  "credential://db",
+		"list":  []any{"env://TEST_API_TOKEN", 1},
+	}
+	if err := resolveSecrets(values, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"db":    map[string]any{"password": "s3cret", "host": "localhost"},
+		"token": "t0ken",
+		"cred":  "s3cret",
+		"list":  []any{"t0ken", 1},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("expected %v, got %v", want, values)
+	}
+	err := resolveSecrets(map[string]any{"a": map[string]any{"b": "env://TEST_MISSING_VAR"}}, "")
+	if err == nil || !strings.Contains(err.Error(), "a.b: environment variable TEST_MISSING_VAR is not set") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	cmd := &cobra.Command{}
+	cmd.Flags().String("config-key-file", keyFile, "")
+
+	buf, err := encryptConfig(key, []byte("port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "config_default.yaml.enc")
+	os.WriteFile(fn, buf, 0600)
+	d := newDaemon(viper.New())
+	d.SetConfigPaths(dir)
+	if found, err := d.findConfig("config_default"); err != nil || found != fn {
+		t.Fatalf("expected %s, got %s %v", fn, found, err)
+	}
+	values, err := d.readConfigFile(cmd, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["port"] != 8080 {
+		t.Errorf("expected port 8080, got %v", values)
+	}
+
+	buf[len(buf)-1] ^= 1
+	os.WriteFile(fn, buf, 0600)
+	if _, err = d.readConfigFile(cmd, fn); err == nil {
+		t.Error("expected an error for a tampered file")
+	}
+	if _, err = parseKey([]byte("short")); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+type profileConfig struct {
+	Port  int    `json:"port" default:"8080"`
+	Debug bool   `json:"debug" default:"false" default_dev:"true"`
+	Host  string `json:"host" default:"localhost"`
+}
+
+func TestEnvProfile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config_default.json"), []byte(`{"port":9000,"host":"db"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "config_default.dev.yaml"), []byte("port: 9001\n"), 0644)
+
+	cfg := &profileConfig{}
+	d := newDaemon(viper.New())
+	d.logger = slog.Default()
+	d.SetConfigPaths(dir)
+	d.RegisterConfig(cfg)
+	cmd := &cobra.Command{}
+	cmd.Flags().String("instance", "default", "")
+	cmd.Flags().String("config", "", "")
+	cmd.Flags().String("env", "", "")
+	if err := d.loadConfig(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9000 || cfg.Debug {
+		t.Errorf("expected the instance config without profile, got %+v", cfg)
+	}
+	cmd.ParseFlags([]string{"--env", "dev"})
+	if err := d.loadConfig(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9001 || !cfg.Debug || cfg.Host != "db" {
+		t.Errorf("expected the dev profile over the instance config, got %+v", cfg)
+	}
+	cmd.ParseFlags([]string{"--env", "../prod"})
+	if err := d.loadConfig(cmd); err == nil {
+		t.Error("expected an invalid env to be rejected")
+	}
+
+	keys, _ := (&Daemon{project: "p", systemd: &Systemd{AppID: "app", Version: "1.2.3"}}).remotePaths(nil, "web", "prod")
+	if keys[0] != "/p/app/1.2.3/web.prod" || keys[len(keys)-1] != "/p/app/latest/default.prod" {
+		t.Errorf("unexpected remote keys %v", keys)
+	}
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// sealGCM encrypts data with AES-GCM, the random nonce is prepended to the ciphertext
+func sealGCM(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, aad), nil
+}
+
+// openGCM decrypts and authenticates data sealed by sealGCM
+func openGCM(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, data[:n], data[n:], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedSuffix marks encrypted config files, e.g. config_default.json.enc
+const encryptedSuffix = ".enc"
+
+// encryptedMagic starts every encrypted config file and is authenticated with it
+var encryptedMagic = []byte("VZCFG1\n")
+
+func isEncrypted(fn string) bool { return strings.HasSuffix(fn, encryptedSuffix) }
+
+func encryptConfig(key, data []byte) ([]byte, error) {
+	buf, err := sealGCM(key, data, encryptedMagic)
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(encryptedMagic), buf...), nil
+}
+
+func decryptConfig(key, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return nil, errors.New("not an encrypted config file")
+	}
+	buf, err := openGCM(key, data[len(encryptedMagic):], encryptedMagic)
+	if err != nil {
+		return nil, errors.New("failed to decrypt config, wrong key or corrupted file")
+	}
+	return buf, nil
+}
+
+// parseKey accepts a 32 byte AES key as raw bytes, hex or base64
+func parseKey(buf []byte) ([]byte, error) {
+	if len(buf) == 32 {
+		return buf, nil
+	}
+	s := strings.TrimSpace(string(buf))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("config key must be 32 bytes, raw, hex or base64 encoded")
+}
+
+// configKeyCredential is the systemd credential holding the config key
+const configKeyCredential = "config-key"
+
+// configKey loads the key of encrypted config files from --config-key-file,
+// the <NAME>_CONFIG_KEY environment variable or the config-key systemd credential
+func (d *Daemon) configKey(cmd *cobra.Command) ([]byte, error) {
+	if fn, _ := cmd.Flags().GetString("config-key-file"); fn != "" {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		return parseKey(buf)
+	}
+	env := d.envName("config_key")
+	if v, ok := os.LookupEnv(env); ok {
+		return parseKey([]byte(v))
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		if buf, err := os.ReadFile(filepath.Join(dir, configKeyCredential)); err == nil {
+			return parseKey(buf)
+		}
+	}
+	return nil, fmt.Errorf("no config key, use --config-key-file, $%s or the %s credential", env, configKeyCredential)
+}
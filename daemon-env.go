@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/spf13/cobra"
+)
+
+var envPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// profile returns the environment profile, e.g. dev, staging or prod, from --env or <NAME>_ENV.
+// Empty means no profile.
+func (d *Daemon) profile(cmd *cobra.Command) (string, error) {
+	return profile(cmd, d.envName("env"))
+}
+
+func profile(cmd *cobra.Command, envVar string) (string, error) {
+	env := ""
+	f := cmd.Flags().Lookup("env")
+	if v, ok := os.LookupEnv(envVar); ok && (f == nil || !f.Changed) {
+		env = v
+	} else if f != nil {
+		env = f.Value.String()
+	}
+	if env != "" && !envPattern.MatchString(env) {
+		return "", fmt.Errorf("invalid env %q, expected lowercase letters, digits, - and _", env)
+	}
+	return env, nil
+}
+
+// environmentOptions passes the profile of the install to the service
+func (spec *unitSpec) environmentOptions() []*unit.UnitOption {
+	if spec.env == "" {
+		return nil
+	}
+	return []*unit.UnitOption{unit.NewUnitOption("Service", "Environment", spec.envVar+"="+spec.env)}
+}
+
+// unitOptions are the repeated options added to every generated service
+func (spec *unitSpec) unitOptions() []*unit.UnitOption {
+	return append(spec.credentialOptions(), spec.environmentOptions()...)
+}
@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// Phase is a point of the lifecycle of the daemon where hooks run
+type Phase string
+
+const (
+	// HookConfigLoaded runs after the config was loaded at startup
+	HookConfigLoaded Phase = "config-loaded"
+	// HookPreStart runs before the action, the component or the workers
+	HookPreStart Phase = "pre-start"
+	// HookPostStart runs once all workers were started, it doesn't run for an action
+	HookPostStart Phase = "post-start"
+	// HookReload runs after the config was reloaded, an error restores the previous config
+	HookReload Phase = "reload"
+	// HookPreStop runs on SIGINT or SIGTERM, or once the action returned. The signal cancels
+	// cmd.Context() of the action, which returns on it, a second signal terminates the process.
+	HookPreStop Phase = "pre-stop"
+	// HookPostStop runs after the action returned or the workers stopped
+	HookPostStop Phase = "post-stop"
+	// HookPostInstall runs after the install command installed the units for the first time.
+	// The install and remove commands load the config before they change the units.
+	HookPostInstall Phase = "post-install"
+	// HookPostUpgrade runs after the install command replaced installed units
+	HookPostUpgrade Phase = "post-upgrade"
+	// HookPreRemove runs before the remove command removes the units, an error keeps them
+	HookPreRemove Phase = "pre-remove"
+	// HookPostRemove runs after the remove command removed the units
+	HookPostRemove Phase = "post-remove"
+)
+
+var phases = []Phase{HookConfigLoaded, HookPreStart, HookPostStart, HookReload, HookPreStop, HookPostStop, HookPostInstall, HookPostUpgrade, HookPreRemove, HookPostRemove}
+
+// HookFunc runs at a phase, cmd is the command being run
+type HookFunc func(cmd *cobra.Command) error
+
+// AddHook registers a hook of the default daemon
+func AddHook(p Phase, fn HookFunc) error { return Default().AddHook(p, fn) }
+
+// WithHook registers a hook, see AddHook
+func WithHook(p Phase, fn HookFunc) Option {
+	return func(d *Daemon) error { return d.AddHook(p, fn) }
+}
+
+// AddHook registers a hook run at the phase, after the hooks registered before it.
+// An error of a hook stops the phase and fails the command, except for HookPreStop and
+// HookPostStop, which run all their hooks.
+func (d *Daemon) AddHook(p Phase, fn HookFunc) error {
+	if !slices.Contains(phases, p) {
+		return fmt.Errorf("unknown hook phase %q", p)
+	}
+	if fn == nil {
+		return fmt.Errorf("%s hook: nil func", p)
+	}
+	if d.hooks == nil {
+		d.hooks = make(map[Phase][]HookFunc)
+	}
+	d.hooks[p] = append(d.hooks[p], fn)
+	return nil
+}
+
+func (d *Daemon) runHooks(cmd *cobra.Command, p Phase) error {
+	var errs []error
+	for _, fn := range d.hooks[p] {
+		if err := fn(cmd); err != nil {
+			errs = append(errs, fmt.Errorf("%s hook: %w", p, err))
+			if p != HookPreStop && p != HookPostStop {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// start loads the config and watches for reloads
+func (d *Daemon) start(cmd *cobra.Command) error {
+	if err := d.loadConfig(cmd); err != nil {
+		return err
+	}
+	if err := d.runHooks(cmd, HookConfigLoaded); err != nil {
+		return err
+	}
+	d.watchReload()
+	return nil
+}
+
+// lifecycle runs the action, or the workers if supervised, between the start and stop hooks
+func (d *Daemon) lifecycle(cmd *cobra.Command, args []string, action ActionFunc, supervised bool) error {
+	if err := d.runHooks(cmd, HookPreStart); err != nil {
+		return err
+	}
+	var (
+		once    sync.Once
+		stopErr error
+	)
+	preStop := func() error {
+		once.Do(func() { stopErr = d.runHooks(cmd, HookPreStop) })
+		return stopErr
+	}
+	var err error
+	if supervised {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		d.supervisor.started = func() error { return d.runHooks(cmd, HookPostStart) }
+		d.supervisor.stopping = func() { preStop() }
+		err = d.supervisor.Run(ctx)
+	} else {
+		parent := cmd.Context()
+		ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+		returned := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				preStop()
+				// Restore the default handling, a second signal terminates an action that doesn't return
+				stop()
+			case <-returned:
+			}
+		}()
+		cmd.SetContext(ctx)
+		err = action(cmd, args)
+		close(returned)
+		stop()
+		cmd.SetContext(parent)
+	}
+	return errors.Join(err, preStop(), d.runHooks(cmd, HookPostStop))
+}
+
+// loadInstallHooks loads the config for the hooks of the install and remove commands, which
+// don't load it otherwise. It is called before the commands change the units, unless none
+// of the phases has hooks or --no-hooks is set.
+func (d *Daemon) loadInstallHooks(cmd *cobra.Command, phases ...Phase) error {
+	if skip, _ := cmd.Flags().GetBool("no-hooks"); skip {
+		return nil
+	}
+	if !slices.ContainsFunc(phases, func(p Phase) bool { return len(d.hooks[p]) > 0 }) {
+		return nil
+	}
+	return d.loadConfig(cmd)
+}
+
+// installHooks runs the hooks of the install and remove commands, unless --no-hooks is set.
+// Their config is loaded by loadInstallHooks.
+func (d *Daemon) installHooks(cmd *cobra.Command, p Phase) error {
+	if skip, _ := cmd.Flags().GetBool("no-hooks"); skip || len(d.hooks[p]) == 0 {
+		return nil
+	}
+	if d.cmd != cmd {
+		return fmt.Errorf("%s hook: config not loaded", p)
+	}
+	return d.runHooks(cmd, p)
+}
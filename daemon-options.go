@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+)
+
+// Option configures a daemon created with New
+type Option func(d *Daemon) error
+
+// WithAppID sets the application ID shown by --version, the name if not set
+func WithAppID(appID string) Option {
+	return func(d *Daemon) error {
+		d.systemd.AppID = appID
+		return nil
+	}
+}
+
+// WithDescription sets the description of the command and of the unit
+func WithDescription(desc string) Option {
+	return func(d *Daemon) error {
+		d.systemd.Description = desc
+		return nil
+	}
+}
+
+// WithVersion sets the version and commit shown by --version, the version is also
+// used by the remote config keys and stamped into the generated units
+func WithVersion(version, commit string) Option {
+	return func(d *Daemon) error {
+		d.systemd.Version, d.commit = version, commit
+		return nil
+	}
+}
+
+// WithLogger sets the logger, vlog.Log if not set
+func WithLogger(log *slog.Logger) Option {
+	return func(d *Daemon) error {
+		if log == nil {
+			return errors.New("nil logger")
+		}
+		d.SetLogger(log)
+		return nil
+	}
+}
+
+// WithConfig registers the pointer to the struct the config is unmarshalled into
+func WithConfig(v any) Option {
+	return func(d *Daemon) error {
+		t := reflect.TypeOf(v)
+		if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct || reflect.ValueOf(v).IsNil() {
+			return fmt.Errorf("config must be a pointer to a struct, got %T", v)
+		}
+		d.RegisterConfig(v)
+		return nil
+	}
+}
+
+// WithConfigPaths replaces the directories searched for config files
+func WithConfigPaths(paths ...string) Option {
+	return func(d *Daemon) error {
+		d.SetConfigPaths(paths...)
+		return nil
+	}
+}
+
+// WithRemoteConfig loads the config from the remote endpoint of project, see EnableRemote
+func WithRemoteConfig(project string, opts ...RemoteOption) Option {
+	return func(d *Daemon) error {
+		if d.remoteConfig {
+			return errors.New("remote config already enabled")
+		}
+		return d.EnableRemote(project, opts...)
+	}
+}
+
+// WithRemotePolicy sets the default of the --remote-policy flag
+func WithRemotePolicy(p RemotePolicy) Option {
+	return func(d *Daemon) error {
+		d.SetRemotePolicy(p)
+		return nil
+	}
+}
+
+// WithUnitOption sets an option of the generated unit
+func WithUnitOption(section, name, value string) Option {
+	return func(d *Daemon) error {
+		d.SetUnitConfig(section, name, value)
+		return nil
+	}
+}
+
+// WithUnitKeysAllowed lets the generated unit have options the validator doesn't know, see AllowUnitKeys
+func WithUnitKeysAllowed(section string, names ...string) Option {
+	return func(d *Daemon) error {
+		d.AllowUnitKeys(section, names...)
+		return nil
+	}
+}
+
+// WithHardening selects the sandboxing preset of the generated unit
+func WithHardening(preset string) Option {
+	return func(d *Daemon) error { return d.SetHardening(preset) }
+}
+
+// WithLimits sets the resource controls of the generated unit
+func WithLimits(l Limits) Option {
+	return func(d *Daemon) error { return d.SetLimits(l) }
+}
+
+// WithCredential declares a credential written to the generated units
+func WithCredential(c Credential) Option {
+	return func(d *Daemon) error { return d.AddCredential(c) }
+}
+
+// WithUserMode manages the service with the service manager of the user instead of the system one.
+// Units are installed in ~/.config/systemd/user and no root privileges are required.
+func WithUserMode() Option {
+	return func(d *Daemon) error {
+		spec := d.systemd.spec
+		spec.user = true
+		if spec.config["Install"]["WantedBy"] == "multi-user.target" {
+			spec.config.set("Install", "WantedBy", "default.target")
+		}
+		return nil
+	}
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// check rejects combinations of options that can't work together
+func (d *Daemon) check() error {
+	if err := d.systemd.spec.check(); err != nil {
+		return err
+	}
+	if d.remoteConfig && d.remotePolicy == LocalOnly {
+		return fmt.Errorf("remote config enabled with the %s policy", LocalOnly)
+	}
+	return nil
+}
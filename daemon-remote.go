@@ -1,15 +1,24 @@
 package daemon
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/spf13/cobra"
 )
 
 const defaultPublicKey = `-----BEGIN PUBLIC KEY-----
@@ -22,37 +31,370 @@ H19ekMDgL248Y4PiK5BqWD4jY1hQfMsQf2ZVs2g6gGNQPAYLMiAXA4ngNurA4Kz+
 xQIDAQAB
 -----END PUBLIC KEY-----`
 
+// RemotePolicy decides how the remote config and its local fallbacks are used
+type RemotePolicy string
+
+const (
+	// RemoteRequired fails when neither the remote config nor its cache can be loaded
+	RemoteRequired RemotePolicy = "remote-required"
+	// RemotePreferred falls back to the cached remote config, then to the local config files.
+	// The remote config is only cached with a config key, the key of encrypted config files.
+	RemotePreferred RemotePolicy = "remote-preferred"
+	// LocalOnly never loads the remote config
+	LocalOnly RemotePolicy = "local-only"
+)
+
+var remotePolicies = []RemotePolicy{RemoteRequired, RemotePreferred, LocalOnly}
+
+// SetRemotePolicy sets the default of the --remote-policy flag of the default daemon
+func SetRemotePolicy(p RemotePolicy) { Default().SetRemotePolicy(p) }
+
+func (d *Daemon) SetRemotePolicy(p RemotePolicy) {
+	d.remotePolicy = p
+	// Keep the default of the flag in sync once remote config is enabled
+	if f := d.root.PersistentFlags().Lookup("remote-policy"); f != nil {
+		f.DefValue = string(p)
+		f.Value.Set(string(p))
+	}
+}
+
+// EnableRemoteConfig loads the config of the default daemon from the remote endpoint of project,
+// verified with the public keys.
+//
+// Deprecated: use EnableRemote with RemotePublicKey.
 func EnableRemoteConfig(project string, publicKey ...string) error {
-	return std.EnableRemoteConfig(project, publicKey...)
+	return Default().EnableRemoteConfig(project, publicKey...)
 }
 
+// Deprecated: use EnableRemote with RemotePublicKey.
 func (d *Daemon) EnableRemoteConfig(project string, publicKey ...string) error {
-	rootCmd.PersistentFlags().String("remote-type", "json", "Remote config type")
-	rootCmd.PersistentFlags().String("remote-endpoint", "", "Remote config endpoint")
+	return d.EnableRemote(project, RemotePublicKey(publicKey...))
+}
 
-	std.project = project
-	std.remoteConfig = true
-	std.secretKey = make([]byte, 32)
-	io.ReadFull(rand.Reader, std.secretKey)
+// EnableRemote loads the config of the default daemon from the remote endpoint of project.
+// Without RemotePublicKey the key of config.app.virzz.com is used.
+func EnableRemote(project string, opts ...RemoteOption) error {
+	return Default().EnableRemote(project, opts...)
+}
 
-	var block *pem.Block
-	if len(publicKey) > 0 && publicKey[0] != "" {
-		block, _ = pem.Decode([]byte(publicKey[0]))
-	} else {
-		block, _ = pem.Decode([]byte(defaultPublicKey))
+func (d *Daemon) EnableRemote(project string, opts ...RemoteOption) error {
+	o := defaultRemoteOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	keys := make([]*rsa.PublicKey, 0, len(o.PublicKeys))
+	for _, data := range o.PublicKeys {
+		if data == "" {
+			continue
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		key, err := ParsePublicKey(defaultPublicKey)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	for _, tmpl := range o.KeyTemplates {
+		if err := checkKeyTemplate(tmpl); err != nil {
+			return err
+		}
+	}
+	if o.CertFile == "" && o.KeyFile != "" {
+		return errors.New("remote client key given without a certificate")
+	}
+	if d.remotePolicy == "" {
+		d.remotePolicy = RemotePreferred
+	}
+	d.project = project
+	d.remoteConfig = true
+	d.remoteEndpoint = o.Endpoint
+	d.remoteKeys = keys
+	d.remoteOptions = o
+	// The unit must be able to reach the remote endpoint whatever the hardening preset
+	d.systemd.spec.network = true
+	if d.created {
+		d.addFlags()
+	}
+	return nil
+}
+
+func (d *Daemon) addRemoteFlags() {
+	d.root.PersistentFlags().String("remote-type", "json", "Remote config type: json, yaml or toml, the Content-Type of the server is used if not set")
+	d.root.PersistentFlags().String("remote-provider", "", "Remote config provider: "+strings.Join(Providers(), ", ")+", selected by the scheme of the endpoint if not set")
+	d.root.PersistentFlags().String("remote-endpoint", "", "Remote config endpoint, the URL scheme selects the provider: virzz or http(s), plain+http(s), etcd, consul, s3 or file")
+	d.root.PersistentFlags().String("remote-policy", string(d.remotePolicy), "Remote config policy: remote-required, remote-preferred or local-only")
+	addRemoteFlags(d.root, &d.remoteOptions)
+}
+
+// stateDir is where the daemon keeps its state, the StateDirectory= of the unit if set
+func stateDir(name string) string {
+	if dir := os.Getenv("STATE_DIRECTORY"); dir != "" {
+		return strings.Split(dir, ":")[0]
+	}
+	if os.Geteuid() == 0 {
+		return filepath.Join("/var/lib", name)
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, name)
 	}
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return errors.New("Failed to decode PEM block containing public key")
+	return filepath.Join(os.TempDir(), name)
+}
+
+// sessionSecret loads the session secret shared with the config server,
+// creating it on first use so that it survives restarts
+func (d *Daemon) sessionSecret() ([]byte, error) {
+	if d.secretKey != nil {
+		return d.secretKey, nil
+	}
+	dir := stateDir(d.systemd.Name)
+	fn := filepath.Join(dir, "remote.key")
+	buf, err := os.ReadFile(fn)
+	if err == nil && len(buf) == 32 {
+		d.secretKey = buf
+		return buf, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	buf = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(fn, buf, 0600); err != nil {
+		return nil, err
+	}
+	d.secretKey = buf
+	return buf, nil
+}
+
+// remoteContentTypes maps the Content-Type of remote config to its config type
+var remoteContentTypes = map[string]string{
+	"application/json":   "json",
+	"text/json":          "json",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"text/x-yaml":        "yaml",
+	"application/toml":   "toml",
+	"text/toml":          "toml",
+}
+
+// remoteType returns the config type of a remote payload: the --remote-type flag if set to a format,
+// else the Content-Type sent by the server, else json
+func remoteType(cmd *cobra.Command, contentType string) (string, error) {
+	t, _ := cmd.Flags().GetString("remote-type")
+	if f := cmd.Flags().Lookup("remote-type"); f == nil || !f.Changed {
+		t = "json"
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if v, ok := remoteContentTypes[mediaType]; ok {
+			t = v
+		}
+	}
+	if t == "" {
+		t = "json"
+	}
+	if t == "yml" {
+		t = "yaml"
+	}
+	if !slices.Contains([]string{"json", "yaml", "toml"}, t) {
+		return "", fmt.Errorf("unsupported remote type %q, expected one of: json, yaml, toml", t)
+	}
+	return t, nil
+}
+
+// redactURL hides the password of an endpoint
+func redactURL(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		c := *u
+		c.User = url.UserPassword(u.User.Username(), redacted)
+		return c.String()
+	}
+	return u.String()
+}
+
+// remoteCache is the last good remote config of an instance
+type remoteCache struct {
+	Source  string         `json:"source"`
+	Fetched time.Time      `json:"fetched"`
+	Values  map[string]any `json:"values"`
+}
+
+func (d *Daemon) remoteCachePath(name string) string {
+	return filepath.Join(stateDir(d.systemd.Name), "remote_"+name+".cache")
+}
+
+// remoteCacheKey derives the key of the remote config cache from the config key, which is kept
+// outside the state directory so that the cache is protected at rest
+func (d *Daemon) remoteCacheKey(cmd *cobra.Command) ([]byte, error) {
+	key, err := d.configKey(cmd)
+	if err != nil {
+		return nil, err
 	}
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("remote-cache"))
+	return mac.Sum(nil), nil
+}
+
+// saveRemoteCache stores the remote config encrypted with the cache key
+func (d *Daemon) saveRemoteCache(key []byte, name string, c *remoteCache) error {
+	buf, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
-	if key, ok := pub.(*rsa.PublicKey); ok {
-		data, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, std.secretKey, nil)
-		viper.RemoteConfig = &RemoteProvider{EncryptSecret: data, logger: std.logger.WithGroup("remote")}
-		viper.SupportedRemoteProviders = append(viper.SupportedRemoteProviders, "virzz")
-		return nil
+	if buf, err = encryptConfig(key, buf); err != nil {
+		return err
+	}
+	fn := d.remoteCachePath(name)
+	if err = os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, buf, 0600)
+}
+
+func (d *Daemon) loadRemoteCache(key []byte, name string) (*remoteCache, error) {
+	buf, err := os.ReadFile(d.remoteCachePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = decryptConfig(key, buf); err != nil {
+		return nil, err
+	}
+	c := &remoteCache{}
+	return c, json.Unmarshal(buf, c)
+}
+
+// readRemote fetches the remote config of the instance, falling back to the cache
+// of the last good one. A nil layer means the remote config is not used.
+func (d *Daemon) readRemote(cmd *cobra.Command, instance, env string) (*configLayer, error) {
+	policy := d.remotePolicy
+	if v := d.v.GetString("remote-policy"); v != "" {
+		policy = RemotePolicy(v)
+	}
+	if !slices.Contains(remotePolicies, policy) {
+		return nil, fmt.Errorf("invalid remote policy %q, expected one of: %s, %s, %s", policy, RemoteRequired, RemotePreferred, LocalOnly)
+	}
+	if policy == LocalOnly {
+		return nil, nil
+	}
+	secret, err := d.sessionSecret()
+	if err != nil {
+		return nil, fmt.Errorf("session secret: %w", err)
+	}
+	remoteEndpoint, _ := cmd.Flags().GetString("remote-endpoint")
+	if remoteEndpoint == "" {
+		remoteEndpoint = d.remoteEndpoint
+	}
+	if remoteEndpoint == "" {
+		remoteEndpoint = defaultRemoteEndpoint
+	}
+	wrapped, err := WrapKey(secret, d.remoteKeys...)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := remoteOptionsFromFlags(cmd, d.remoteOptions)
+	if err != nil {
+		return nil, err
+	}
+	client, err := opts.client()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	for name, value := range map[string]string{
+		RemoteInstanceHeader: instance,
+		RemoteHostnameHeader: hostname,
+		RemoteVersionHeader:  d.systemd.Version,
+	} {
+		if _, ok := opts.Headers[name]; !ok {
+			opts.Headers[name] = value
+		}
+	}
+	if !strings.Contains(remoteEndpoint, "://") {
+		remoteEndpoint = "virzz://" + remoteEndpoint
+	}
+	endpoint, err := url.Parse(remoteEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("remote endpoint: %w", err)
+	}
+	name, _ := cmd.Flags().GetString("remote-provider")
+	logger := d.logger.WithGroup("remote")
+	p, err := newProvider(name, &ProviderOptions{
+		Endpoint: endpoint,
+		Client:   client,
+		Headers:  opts.Headers,
+		Keys:     wrapped,
+		Secret:   secret,
+		Logger:   logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		values      map[string]any
+		buf         []byte
+		contentType string
+		key         string
+	)
+	cacheName := instance
+	if env != "" {
+		cacheName += "." + env
+	}
+	keys, err := d.remotePaths(opts.KeyTemplates, instance, env)
+	if err == nil && len(keys) == 0 {
+		err = errors.New("every remote key has an empty placeholder")
+	}
+	for i, k := range keys {
+		key = k
+		buf, contentType, err = fetchRetry(context.Background(), p, key, &opts, logger)
+		if !errors.Is(err, ErrConfigNotFound) {
+			break
+		}
+		if i+1 < len(keys) {
+			logger.Info("Remote config not found, trying the next key", "key", key, "next", keys[i+1])
+		}
+	}
+	if err == nil {
+		var t string
+		if t, err = remoteType(cmd, contentType); err == nil {
+			values, err = parseConfig(buf, t)
+		}
+	}
+	// Without a config key the remote config is not cached
+	cacheKey, kerr := d.remoteCacheKey(cmd)
+	if err == nil {
+		c := &remoteCache{Source: redactURL(endpoint) + key, Fetched: time.Now(), Values: values}
+		if kerr != nil {
+			d.logger.Warn("Remote config not cached", "err", kerr.Error())
+		} else if err = d.saveRemoteCache(cacheKey, cacheName, c); err != nil {
+			d.logger.Warn("Failed to cache remote config", "err", err.Error())
+		}
+		return &configLayer{layerRemote, c.Source, c.Values}, nil
+	}
+	d.logger.Warn("Failed to load remote config", "err", err.Error())
+
+	cerr := kerr
+	var c *remoteCache
+	if cerr == nil {
+		c, cerr = d.loadRemoteCache(cacheKey, cacheName)
+	}
+	if cerr == nil {
+		d.logger.Warn("Using cached remote config, it may be stale", "fetched", c.Fetched.Format(time.RFC3339), "age", time.Since(c.Fetched).Round(time.Second).String())
+		return &configLayer{layerRemote, "cache " + c.Source, c.Values}, nil
+	}
+	if !os.IsNotExist(cerr) {
+		d.logger.Warn("Failed to load cached remote config", "err", cerr.Error())
+	}
+	if policy == RemoteRequired {
+		return nil, fmt.Errorf("remote config required: %w", err)
 	}
-	return errors.New("not an RSA public key")
+	return nil, nil
 }
@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+)
+
+// Secret reference schemes resolved in config values
+const (
+	secretFile       = "file://"
+	secretEnv        = "env://"
+	secretCredential = "credential://"
+)
+
+// resolveSecret returns the value a secret reference points to, ok is false for plain values
+func resolveSecret(value string) (secret string, ok bool, err error) {
+	var buf []byte
+	switch {
+	case strings.HasPrefix(value, secretFile):
+		buf, err = os.ReadFile(strings.TrimPrefix(value, secretFile))
+	case strings.HasPrefix(value, secretEnv):
+		name := strings.TrimPrefix(value, secretEnv)
+		v, found := os.LookupEnv(name)
+		if !found {
+			return "", true, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, true, nil
+	case strings.HasPrefix(value, secretCredential):
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", true, errors.New("CREDENTIALS_DIRECTORY is not set, is the credential declared in the unit?")
+		}
+		buf, err = os.ReadFile(filepath.Join(dir, strings.TrimPrefix(value, secretCredential)))
+	default:
+		return value, false, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+	return strings.TrimRight(string(buf), "\r\n"), true, nil
+}
+
+// resolveSecrets replaces secret references in nested settings in place
+func resolveSecrets(m map[string]any, prefix string) error {
+	var errs []error
+	for k, v := range m {
+		key := prefix + k
+		switch v := v.(type) {
+		case string:
+			secret, ok, err := resolveSecret(v)
+			if err != nil {
+				errs = append(errs, &FieldError{key, err})
+			} else if ok {
+				m[k] = secret
+			}
+		case map[string]any:
+			if err := resolveSecrets(v, key+"."); err != nil {
+				errs = append(errs, err)
+			}
+		case []any:
+			for i, item := range v {
+				if s, isString := item.(string); isString {
+					secret, ok, err := resolveSecret(s)
+					if err != nil {
+						errs = append(errs, &FieldError{fmt.Sprintf("%s.%d", key, i), err})
+					} else if ok {
+						v[i] = secret
+					}
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Credential is a secret systemd passes to the service, referenced in the config as credential://<Name>
+type Credential struct {
+	Name string
+	// Path of the secret, emitted as LoadCredential=
+	Path string
+	// Path is encrypted with systemd-creds, emitted as LoadCredentialEncrypted=
+	Encrypted bool
+	// Data is the output of systemd-creds encrypt, emitted as SetCredentialEncrypted=
+	Data string
+}
+
+// AddCredential declares a credential written to the generated units of the default daemon
+func AddCredential(c Credential) error { return Default().AddCredential(c) }
+
+func (d *Daemon) AddCredential(c Credential) error {
+	spec := d.systemd.spec
+	if c.Name == "" || strings.ContainsAny(c.Name, "/: ") {
+		return fmt.Errorf("invalid credential name %q", c.Name)
+	}
+	if (c.Path == "") == (c.Data == "") {
+		return fmt.Errorf("credential %s: either Path or Data is required", c.Name)
+	}
+	for _, other := range spec.credentials {
+		if other.Name == c.Name {
+			return fmt.Errorf("credential %s already declared", c.Name)
+		}
+	}
+	spec.credentials = append(spec.credentials, c)
+	return nil
+}
+
+func (spec *unitSpec) credentialOptions() []*unit.UnitOption {
+	opts := make([]*unit.UnitOption, 0, len(spec.credentials))
+	for _, c := range spec.credentials {
+		switch {
+		case c.Data != "":
+			opts = append(opts, unit.NewUnitOption("Service", "SetCredentialEncrypted", c.Name+": "+c.Data))
+		case c.Encrypted:
+			opts = append(opts, unit.NewUnitOption("Service", "LoadCredentialEncrypted", c.Name+":"+c.Path))
+		default:
+			opts = append(opts, unit.NewUnitOption("Service", "LoadCredential", c.Name+":"+c.Path))
+		}
+	}
+	return opts
+}
@@ -0,0 +1,328 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WorkerFunc is a long running part of the daemon, it returns when ctx is cancelled
+type WorkerFunc func(ctx context.Context) error
+
+// RestartPolicy decides when a worker is restarted, like Restart= of a systemd service
+type RestartPolicy string
+
+const (
+	// RestartNever leaves the worker stopped when it returns
+	RestartNever RestartPolicy = "never"
+	// RestartOnFailure restarts the worker when it returns an error or panics
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartAlways restarts the worker whenever it returns
+	RestartAlways RestartPolicy = "always"
+)
+
+// Worker is a WorkerFunc run by a Supervisor
+type Worker struct {
+	Name string
+	Run  WorkerFunc
+	// Restart is RestartOnFailure if empty
+	Restart RestartPolicy
+	// RestartWait is the wait before the first restart, doubled on every restart up to RestartMaxWait.
+	// The defaults are 100ms and 30s, a worker running longer than RestartMaxWait starts over.
+	RestartWait    time.Duration
+	RestartMaxWait time.Duration
+	// MaxRestarts fails the worker once it was restarted that often, 0 is unlimited
+	MaxRestarts int
+	// After lists the workers started before and stopped after this one
+	After []string
+	// Notify delays the workers started after this one until it calls Ready, they are not
+	// started if it exits before
+	Notify bool
+}
+
+var errExited = errors.New("exited")
+
+func (w *Worker) restart(err error) bool {
+	switch w.Restart {
+	case RestartNever:
+		return false
+	case RestartAlways:
+		return true
+	}
+	return err != nil
+}
+
+// Supervisor runs workers, restarting them according to their policy.
+// A worker failing for good stops all workers and fails the supervisor.
+type Supervisor struct {
+	Logger *slog.Logger
+	// StopTimeout is how long a stopping worker is waited for, 0 waits forever
+	StopTimeout time.Duration
+
+	workers []*Worker
+	// started and stopping are called once all workers were started and before they are stopped
+	started  func() error
+	stopping func()
+}
+
+// Add registers a worker, it is started by Run
+func (s *Supervisor) Add(w Worker) error {
+	if w.Name == "" || w.Run == nil {
+		return errors.New("worker requires a Name and Run")
+	}
+	if w.Restart == "" {
+		w.Restart = RestartOnFailure
+	}
+	if !slices.Contains([]RestartPolicy{RestartNever, RestartOnFailure, RestartAlways}, w.Restart) {
+		return fmt.Errorf("worker %s: invalid restart policy %q, expected one of: %s, %s, %s", w.Name, w.Restart, RestartNever, RestartOnFailure, RestartAlways)
+	}
+	if w.RestartWait <= 0 {
+		w.RestartWait = 100 * time.Millisecond
+	}
+	if w.RestartMaxWait <= 0 {
+		w.RestartMaxWait = 30 * time.Second
+	}
+	if s.worker(w.Name) != nil {
+		return fmt.Errorf("worker %s already registered", w.Name)
+	}
+	s.workers = append(s.workers, &w)
+	return nil
+}
+
+// Len returns the number of registered workers
+func (s *Supervisor) Len() int { return len(s.workers) }
+
+func (s *Supervisor) worker(name string) *Worker {
+	for _, w := range s.workers {
+		if w.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// order sorts the workers so that every worker follows the workers it is started after,
+// keeping the order of registration otherwise
+func (s *Supervisor) order() ([]*Worker, error) {
+	for _, w := range s.workers {
+		for _, dep := range w.After {
+			if s.worker(dep) == nil {
+				return nil, fmt.Errorf("worker %s: unknown worker %s in After", w.Name, dep)
+			}
+		}
+	}
+	order := make([]*Worker, 0, len(s.workers))
+	done := make(map[string]bool, len(s.workers))
+	for len(order) < len(s.workers) {
+		progress := false
+		for _, w := range s.workers {
+			if done[w.Name] || slices.ContainsFunc(w.After, func(dep string) bool { return !done[dep] }) {
+				continue
+			}
+			order = append(order, w)
+			done[w.Name] = true
+			progress = true
+		}
+		if !progress {
+			return nil, errors.New("workers have a dependency cycle")
+		}
+	}
+	return order, nil
+}
+
+type readyKey struct{}
+
+// Ready tells the supervisor that the worker of ctx is ready, starting the workers
+// that are started after it if it has Notify set
+func Ready(ctx context.Context) {
+	if ready, ok := ctx.Value(readyKey{}).(func()); ok {
+		ready()
+	}
+}
+
+type workerState struct {
+	cancel context.CancelFunc
+	// ready is closed once the worker is ready, done once it is gone
+	ready   chan struct{}
+	done    chan struct{}
+	err     error
+	stopped bool
+}
+
+// Run starts the workers in dependency order and supervises them until ctx is cancelled,
+// every worker returned for good or one of them failed. The workers are stopped in
+// reverse order and their errors are returned joined.
+func (s *Supervisor) Run(ctx context.Context) error {
+	order, err := s.order()
+	if err != nil {
+		return err
+	}
+	states := make(map[string]*workerState, len(order))
+	started := make([]*Worker, 0, len(order))
+	failed := make(chan string, len(order))
+	interrupted := false
+	var errs []error
+start:
+	for _, w := range order {
+		for _, dep := range w.After {
+			dst := states[dep]
+			select {
+			case <-dst.ready:
+				continue
+			case <-dst.done:
+			case <-ctx.Done():
+				interrupted = true
+				break start
+			case name := <-failed:
+				s.logger().Error("Worker "+name+" failed, stopping", "err", states[name].err.Error())
+				interrupted = true
+				break start
+			}
+			// The dependency is gone, its dependents are only started if it got ready before
+			select {
+			case <-dst.ready:
+			default:
+				if dst.err != nil {
+					s.logger().Error("Worker "+dep+" failed, stopping", "err", dst.err.Error())
+				} else {
+					errs = append(errs, fmt.Errorf("worker %s: exited before it was ready", dep))
+				}
+				interrupted = true
+				break start
+			}
+		}
+		st := &workerState{ready: make(chan struct{}), done: make(chan struct{})}
+		var once sync.Once
+		ready := func() { once.Do(func() { close(st.ready) }) }
+		if !w.Notify {
+			ready()
+		}
+		var wctx context.Context
+		wctx, st.cancel = context.WithCancel(context.WithValue(context.WithoutCancel(ctx), readyKey{}, ready))
+		states[w.Name] = st
+		started = append(started, w)
+		go func(w *Worker) {
+			defer close(st.done)
+			if st.err = s.supervise(wctx, w); st.err != nil {
+				failed <- w.Name
+			}
+		}(w)
+	}
+
+	if !interrupted && s.started != nil {
+		if err := s.started(); err != nil {
+			errs = append(errs, err)
+			interrupted = true
+		}
+	}
+	if !interrupted {
+		all := make(chan struct{})
+		go func() {
+			for _, w := range started {
+				<-states[w.Name].done
+			}
+			close(all)
+		}()
+		select {
+		case <-ctx.Done():
+		case name := <-failed:
+			s.logger().Error("Worker "+name+" failed, stopping", "err", states[name].err.Error())
+		case <-all:
+		}
+	}
+
+	if s.stopping != nil {
+		s.stopping()
+	}
+	for i := len(started) - 1; i >= 0; i-- {
+		w := started[i]
+		st := states[w.Name]
+		st.cancel()
+		var timeout <-chan time.Time
+		if s.StopTimeout > 0 {
+			timeout = time.After(s.StopTimeout)
+		}
+		select {
+		case <-st.done:
+			st.stopped = true
+		case <-timeout:
+			errs = append(errs, fmt.Errorf("worker %s: not stopped within %s", w.Name, s.StopTimeout))
+		}
+	}
+	for _, w := range started {
+		if st := states[w.Name]; st.stopped && st.err != nil {
+			errs = append(errs, fmt.Errorf("worker %s: %w", w.Name, st.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// supervise runs the worker until it returns for good, the error is nil for a clean exit
+func (s *Supervisor) supervise(ctx context.Context, w *Worker) error {
+	logger := s.logger().With("worker", w.Name)
+	wait := w.RestartWait
+	for restarts := 0; ; restarts++ {
+		begin := time.Now()
+		err := runWorker(ctx, w)
+		if ctx.Err() != nil {
+			// Stopped by the supervisor
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+		if !w.restart(err) {
+			return err
+		}
+		if err == nil {
+			err = errExited
+		}
+		if w.MaxRestarts > 0 && restarts >= w.MaxRestarts {
+			return fmt.Errorf("restart limit of %d reached: %w", w.MaxRestarts, err)
+		}
+		if time.Since(begin) > w.RestartMaxWait {
+			wait = w.RestartWait
+		}
+		logger.Warn("Worker stopped, restarting", "err", err.Error(), "wait", wait.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, w.RestartMaxWait)
+	}
+}
+
+// runWorker runs the worker once, turning a panic into an error
+func runWorker(ctx context.Context, w *Worker) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return w.Run(ctx)
+}
+
+// AddWorker registers a worker of the default daemon
+func AddWorker(w Worker) error { return Default().AddWorker(w) }
+
+// WithWorker registers a worker, see AddWorker
+func WithWorker(w Worker) Option {
+	return func(d *Daemon) error { return d.AddWorker(w) }
+}
+
+// AddWorker registers a worker. The workers are supervised when Execute is given no action,
+// until the daemon receives SIGINT or SIGTERM.
+func (d *Daemon) AddWorker(w Worker) error { return d.supervisor.Add(w) }
@@ -0,0 +1,109 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	event := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	service := func(name string) WorkerFunc {
+		return func(ctx context.Context) error {
+			event("start " + name)
+			Ready(ctx)
+			<-ctx.Done()
+			event("stop " + name)
+			return ctx.Err()
+		}
+	}
+	runs := 0
+	var s Supervisor
+	for _, w := range []Worker{
+		{Name: "api", Run: service("api"), After: []string{"db"}},
+		{Name: "db", Run: service("db"), Notify: true},
+		{Name: "flaky", RestartWait: time.Millisecond, Run: func(ctx context.Context) error {
+			if runs++; runs < 3 {
+				panic("boom")
+			}
+			event("flaky ok")
+			return nil
+		}},
+	} {
+		if err := s.Add(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Add(Worker{Name: "db", Run: service("db")}); err == nil {
+		t.Error("expected a duplicate worker to be rejected")
+	}
+	if err := s.Add(Worker{Name: "x", Run: service("x"), Restart: "sometimes"}); err == nil {
+		t.Error("expected an invalid restart policy to be rejected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			mu.Lock()
+			n := len(events)
+			mu.Unlock()
+			if n == 3 {
+				cancel()
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 3 || !slices.Contains(events, "flaky ok") {
+		t.Errorf("expected flaky to be restarted until it succeeds, ran %d times", runs)
+	}
+	order := slices.DeleteFunc(slices.Clone(events), func(e string) bool { return e == "flaky ok" })
+	if !slices.Equal(order, []string{"start db", "start api", "stop api", "stop db"}) {
+		t.Errorf("unexpected start and stop order %v", order)
+	}
+
+	// A worker exceeding its restarts stops the others and fails the supervisor
+	s = Supervisor{}
+	s.Add(Worker{Name: "db", Run: service("db"), Restart: RestartNever})
+	s.Add(Worker{Name: "bad", Run: func(context.Context) error { return errors.New("broken") },
+		Restart: RestartAlways, RestartWait: time.Millisecond, MaxRestarts: 2})
+	err := s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "worker bad: restart limit of 2 reached: broken") {
+		t.Errorf("expected the restart limit error, got %v", err)
+	}
+
+	// Dependents of a Notify worker gone before it was ready are not started
+	started := false
+	s = Supervisor{}
+	s.Add(Worker{Name: "db", Notify: true, Restart: RestartNever, Run: func(context.Context) error { return errors.New("down") }})
+	s.Add(Worker{Name: "api", After: []string{"db"}, Run: func(ctx context.Context) error {
+		started = true
+		<-ctx.Done()
+		return nil
+	}})
+	if err = s.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "worker db: down") || started {
+		t.Errorf("expected the failed dependency to stop the start, got %v, started %v", err, started)
+	}
+
+	s = Supervisor{}
+	s.Add(Worker{Name: "a", Run: service("a"), After: []string{"b"}})
+	s.Add(Worker{Name: "b", Run: service("b"), After: []string{"a"}})
+	if err = s.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a dependency cycle error, got %v", err)
+	}
+}
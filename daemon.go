@@ -1,10 +1,14 @@
 package daemon
 
 import (
+	"crypto/rsa"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/cobra"
@@ -15,126 +19,206 @@ import (
 const defaultRemoteEndpoint = "config.app.virzz.com"
 
 var (
-	std            *Daemon
-	registerConfig any = nil
-	rootCmd            = &cobra.Command{
-		CompletionOptions: cobra.CompletionOptions{HiddenDefaultCmd: true},
-		SilenceErrors:     true,
-		SilenceUsage:      true,
-		RunE: func(_ *cobra.Command, _ []string) error {
-			panic("daemon action not implemented")
-		},
-	}
+	stdMu sync.Mutex
+	std   *Daemon
 )
 
+// Default returns the daemon the package-level functions operate on, the first one created
+// with New. Before New it returns a placeholder which is adopted by the first New.
+func Default() *Daemon {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	if std == nil {
+		std = newDaemon(viper.GetViper())
+	}
+	return std
+}
+
 func unmarshalConfig(c *mapstructure.DecoderConfig) { c.TagName = "json" }
-func AddCommand(cmds ...*cobra.Command)             { rootCmd.AddCommand(cmds...) }
-func RootCmd() *cobra.Command                       { return rootCmd }
-func RegisterConfig(v any)                          { registerConfig = v }
-func SetLogger(log *slog.Logger)                    { std.SetLogger(log) }
+func AddCommand(cmds ...*cobra.Command)             { Default().AddCommand(cmds...) }
+func RootCmd() *cobra.Command                       { return Default().RootCmd() }
+func RegisterConfig(v any)                          { Default().RegisterConfig(v) }
+func SetLogger(log *slog.Logger)                    { Default().SetLogger(log) }
 
 type Daemon struct {
 	logger         *slog.Logger
 	systemd        *Systemd
+	root           *cobra.Command
+	v              *viper.Viper
+	config         any
+	configPaths    []string
 	project        string
 	remoteEndpoint string
 	remoteConfig   bool
+	remoteKeys     []*rsa.PublicKey
+	remotePolicy   RemotePolicy
+	remoteOptions  RemoteOptions
 	secretKey      []byte
+	layers         []configLayer
+	components     []*Component
+	supervisor     Supervisor
+	hooks          map[Phase][]HookFunc
+	configInit     reflect.Value
+	cmd            *cobra.Command
+	commit         string
+	// created is set once New claimed the daemon, a placeholder returned by Default is not
+	created bool
+	// configMu guards the config against reloads, reloadMu serializes them
+	configMu sync.RWMutex
+	reloadMu sync.Mutex
+	// unwatch stops reloading on SIGHUP
+	unwatch func()
 }
 
+func newDaemon(v *viper.Viper) *Daemon {
+	return &Daemon{
+		v: v,
+		root: &cobra.Command{
+			CompletionOptions: cobra.CompletionOptions{HiddenDefaultCmd: true},
+			SilenceErrors:     true,
+			SilenceUsage:      true,
+			RunE: func(_ *cobra.Command, _ []string) error {
+				panic("daemon action not implemented")
+			},
+		},
+		systemd: &Systemd{spec: newUnitSpec()},
+	}
+}
+
+func (d *Daemon) AddCommand(cmds ...*cobra.Command) { d.root.AddCommand(cmds...) }
+func (d *Daemon) RootCmd() *cobra.Command           { return d.root }
+
+// Viper returns the viper instance holding the merged config of the daemon,
+// see ReadConfig for reading it while the daemon reloads
+func (d *Daemon) Viper() *viper.Viper { return d.v }
+
+// RegisterConfig sets the pointer to the struct the config is unmarshalled into
+func (d *Daemon) RegisterConfig(v any) { d.config = v }
+
 func (d *Daemon) SetLogger(log *slog.Logger) {
 	d.logger = log.WithGroup("daemon")
 	d.systemd.logger = log.WithGroup("systemd")
-	viper.WithLogger(log.WithGroup("viper"))
+	d.supervisor.Logger = log.WithGroup("supervisor")
 }
 
-// New - Create a new daemon
-func New(appID, name, desc, version, commit string) (*Daemon, error) {
-	rootCmd.Use = name
-	rootCmd.Short = desc
-	rootCmd.Version = appID + " " + version + " " + commit
-	rootCmd.PersistentFlags().StringP("instance", "i", "default", "Get instance name from systemd template")
-	rootCmd.PersistentFlags().StringP("config", "c", "", "Set custom config file")
-	std = &Daemon{
-		systemd: &Systemd{
-			Name:        strings.ToLower(name),
-			Description: desc,
-			Version:     version,
-			AppID:       appID,
-		},
+// New creates the daemon of the named service, configured by the options.
+// The first daemon becomes the default one of the package-level functions and uses
+// the global viper instance, later ones are independent with their own viper instance.
+func New(name string, opts ...Option) (*Daemon, error) {
+	if !namePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid daemon name %q", name)
 	}
-	std.systemd.Command(rootCmd)
-	return std, nil
-}
+	stdMu.Lock()
+	d, isStd := std, std == nil
+	switch {
+	case d == nil:
+		d = newDaemon(viper.GetViper())
+		std = d
+	case d.created:
+		d, isStd = newDaemon(viper.New()), false
+	}
+	// Claim the daemon while holding the lock, a concurrent New creates its own
+	d.created = true
+	stdMu.Unlock()
 
-type ActionFunc func(cmd *cobra.Command, args []string) error
+	restore := d.snapshot()
+	d.root.Use = name
+	d.systemd.Name = strings.ToLower(name)
+	d.systemd.spec.envVar = d.envName("env")
+	if err := d.apply(opts); err != nil {
+		// Leave an adopted placeholder as the package-level functions configured it
+		restore()
+		stdMu.Lock()
+		d.created = false
+		if isStd {
+			std = nil
+		}
+		stdMu.Unlock()
+		return nil, err
+	}
 
-func Execute(action ActionFunc) {
-	if err := ExecuteE(action); err != nil {
-		fmt.Println("Error: ", err)
-		os.Exit(1)
+	if d.systemd.AppID == "" {
+		d.systemd.AppID = name
+	}
+	d.root.Short = d.systemd.Description
+	if d.systemd.Version != "" {
+		d.root.Version = strings.Join(strings.Fields(d.systemd.AppID+" "+d.systemd.Version+" "+d.commit), " ")
 	}
+	d.root.PersistentFlags().StringP("instance", "i", "default", "Get instance name from systemd template")
+	d.root.PersistentFlags().StringP("config", "c", "", "Set custom config file")
+	d.root.PersistentFlags().String("config-key-file", "", "Key file of encrypted config files")
+	d.root.PersistentFlags().String("env", "", "Environment profile, e.g. dev, staging or prod, selects config_<instance>.<env> and default_<env> tags")
+	d.addFlags()
+	d.systemd.hooks, d.systemd.loadHooks = d.installHooks, d.loadInstallHooks
+	d.systemd.Command(d.root)
+	d.configCommand(d.root)
+	return d, nil
 }
 
-func ExecuteE(action ActionFunc) error {
-	if std.logger == nil || std.systemd.logger == nil {
-		std.SetLogger(vlog.Log)
+// snapshot returns a function restoring the state New and the options change
+func (d *Daemon) snapshot() (restore func()) {
+	systemd, spec := *d.systemd, *d.systemd.spec
+	spec.config, spec.allowed = spec.config.clone(), spec.allowed.clone()
+	use, logger, config, configPaths, commit := d.root.Use, d.logger, d.config, d.configPaths, d.commit
+	project, endpoint, remote, keys := d.project, d.remoteEndpoint, d.remoteConfig, d.remoteKeys
+	policy, remoteOptions := d.remotePolicy, d.remoteOptions
+	components, supervisor, hooks := d.components, d.supervisor, maps.Clone(d.hooks)
+	return func() {
+		*d.systemd, *d.systemd.spec = systemd, spec
+		d.root.Use, d.logger, d.config, d.configPaths, d.commit = use, logger, config, configPaths, commit
+		d.project, d.remoteEndpoint, d.remoteConfig, d.remoteKeys = project, endpoint, remote, keys
+		d.remotePolicy, d.remoteOptions = policy, remoteOptions
+		d.components, d.supervisor, d.hooks = components, supervisor, hooks
 	}
-	rootCmd.PreRunE = func(cmd *cobra.Command, args []string) (err error) {
-		instance, _ := cmd.PersistentFlags().GetString("instance")
-		config, _ := cmd.PersistentFlags().GetString("config")
-		viper.SetConfigType("json")
-		if config != "" {
-			viper.SetConfigFile(config)
-		} else {
-			viper.AddConfigPath(".")
-			viper.SetConfigName("config_" + instance)
-		}
+}
 
-		configLoaded := false
-		if std.remoteConfig {
-			remoteEndpoint, _ := cmd.PersistentFlags().GetString("remote-endpoint")
-			if remoteEndpoint == "" {
-				remoteEndpoint = std.remoteEndpoint
-			}
-			if remoteEndpoint == "" {
-				remoteEndpoint = defaultRemoteEndpoint
-			}
-			key := fmt.Sprintf("/%s/%s/%s/%s", std.project, std.systemd.AppID, std.systemd.Version, instance)
-			err = viper.AddSecureRemoteProvider("virzz", remoteEndpoint, key, string(std.secretKey))
-			if err != nil {
-				std.logger.Warn("Failed to add remote config provider", "err", err.Error())
-			} else {
-				err = viper.ReadRemoteConfig()
-				if err != nil {
-					std.logger.Warn("Failed to load remote config", "err", err.Error())
-				} else {
-					configLoaded = true
-				}
-			}
-		}
+// addFlags registers the flags of the remote config and of the components. Options only
+// record them, so that a failed New leaves the command of an adopted placeholder untouched.
+func (d *Daemon) addFlags() {
+	flags := d.root.PersistentFlags()
+	if d.remoteConfig && flags.Lookup("remote-endpoint") == nil {
+		d.addRemoteFlags()
+	}
+	if len(d.components) > 0 && flags.Lookup("component") == nil {
+		d.addComponentFlags()
+	}
+}
 
-		if !configLoaded {
-			err = viper.ReadInConfig()
-			if err != nil {
-				return err
-			}
+func (d *Daemon) apply(opts []Option) error {
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			return err
 		}
+	}
+	return d.check()
+}
 
-		if registerConfig != nil {
-			if err := viper.Unmarshal(registerConfig, unmarshalConfig); err != nil {
-				return err
-			}
-		}
-		return nil
+type ActionFunc func(cmd *cobra.Command, args []string) error
+
+func Execute(action ActionFunc)        { Default().Execute(action) }
+func ExecuteE(action ActionFunc) error { return Default().ExecuteE(action) }
+
+func (d *Daemon) Execute(action ActionFunc) {
+	if err := d.ExecuteE(action); err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+}
+
+func (d *Daemon) ExecuteE(action ActionFunc) error {
+	if d.logger == nil || d.systemd.logger == nil {
+		d.SetLogger(vlog.Log)
 	}
-	rootCmd.RunE = action
-	viper.BindPFlags(rootCmd.PersistentFlags())
-	viper.BindPFlags(rootCmd.Flags())
-	viper.SetEnvPrefix(rootCmd.Use)
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AutomaticEnv()
-	if err := rootCmd.Execute(); err != nil {
+	d.addFlags()
+	d.root.PreRunE = func(cmd *cobra.Command, _ []string) error { return d.start(cmd) }
+	defer d.stopReload()
+	d.root.RunE = d.run(action)
+	d.v.BindPFlags(d.root.PersistentFlags())
+	d.v.BindPFlags(d.root.Flags())
+	d.v.SetEnvPrefix(d.root.Use)
+	d.v.SetEnvKeyReplacer(envReplacer)
+	d.v.AutomaticEnv()
+	if err := d.root.Execute(); err != nil {
 		return err
 	}
 	return nil
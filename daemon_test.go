@@ -0,0 +1,320 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// resetDefault clears the default daemon for the test and restores it afterwards
+func resetDefault(t *testing.T) {
+	t.Helper()
+	prev := std
+	std = nil
+	t.Cleanup(func() { std = prev })
+}
+
+func TestDaemonInstances(t *testing.T) {
+	resetDefault(t)
+	a, err := New("svc-a", WithAppID("com.virzz.a"), WithDescription("Service A"), WithVersion("1.0.0", "dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("svc-b", WithAppID("com.virzz.b"), WithDescription("Service B"), WithVersion("2.0.0", "dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Default() != a || a.v == b.v || a.root == b.root {
+		t.Fatal("expected the first daemon to be the default and the second to be independent")
+	}
+
+	type config struct {
+		Port int `json:"port"`
+	}
+	var cfgA, cfgB config
+	for _, c := range []struct {
+		d    *Daemon
+		cfg  *config
+		port string
+	}{{a, &cfgA, "1"}, {b, &cfgB, "2"}} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "config_default.json"), []byte(`{"port":`+c.port+`}`), 0644)
+		c.d.SetConfigPaths(dir)
+		c.d.RegisterConfig(c.cfg)
+		c.d.root.ParseFlags(nil)
+		if err := c.d.loadConfig(c.d.root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfgA.Port != 1 || cfgB.Port != 2 || a.v.GetInt("port") != 1 || b.v.GetInt("port") != 2 {
+		t.Errorf("expected separate configs, got %d / %d", cfgA.Port, cfgB.Port)
+	}
+
+	if err = b.EnableRemote("p"); err != nil {
+		t.Fatal(err)
+	}
+	if a.root.PersistentFlags().Lookup("remote-endpoint") != nil || a.remoteConfig {
+		t.Error("expected the remote config of b not to leak into a")
+	}
+	b.SetUnitConfig("Service", "Type", "simple")
+	unitA, _ := a.systemd.spec.createUnit(true, a.systemd.Name, a.systemd.Description, "/bin/sh")
+	unitB, _ := b.systemd.spec.createUnit(true, b.systemd.Name, b.systemd.Description, "/bin/sh")
+	if strings.Contains(string(unitA), "Type=simple") || !strings.Contains(string(unitB), "Type=simple") {
+		t.Errorf("expected the unit config of b only in its unit:\n%s", unitA)
+	}
+	b.SetUnitConfig("Service", "Restrat", "always")
+	unitB, _ = b.systemd.spec.createUnit(true, b.systemd.Name, b.systemd.Description, "/bin/sh")
+	if err = b.systemd.checkUnit("b.service", unitB); err == nil || !strings.Contains(err.Error(), "Restrat") {
+		t.Errorf("expected the misspelt key to fail the install, got %v", err)
+	}
+	b.AllowUnitKeys("Service", "Restrat")
+	if err = b.systemd.checkUnit("b.service", unitB); err != nil {
+		t.Errorf("expected the allowed key to pass, got %v", err)
+	}
+	if a.envName("env") != "SVC_A_ENV" || b.systemd.spec.envVar != "SVC_B_ENV" {
+		t.Errorf("unexpected env names %s, %s", a.envName("env"), b.systemd.spec.envVar)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	resetDefault(t)
+	for _, c := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"../svc", nil, "invalid daemon name"},
+		{"svc", []Option{WithConfig(struct{}{})}, "pointer to a struct"},
+		{"svc", []Option{WithHardening("paranoid")}, "unknown hardening preset"},
+		{"svc", []Option{WithUserMode(), WithHardening(HardeningStrict)}, "DynamicUser"},
+		{"svc", []Option{WithUnitOption("Service", "User", "nobody"), WithUserMode()}, "User="},
+		{"svc", []Option{WithRemoteConfig("p"), WithRemotePolicy(LocalOnly)}, "local-only"},
+	} {
+		if _, err := New(c.name, c.opts...); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s %d options: expected error containing %q, got %v", c.name, len(c.opts), c.want, err)
+		}
+	}
+	if std != nil {
+		t.Error("expected a failed New not to become the default daemon")
+	}
+
+	placeholder := Default()
+	placeholder.SetUnitConfig("Service", "Nice", "5")
+	opts := []Option{WithRemoteConfig("p"), WithUnitOption("Service", "User", "nobody"), WithUserMode()}
+	if _, err := New("svc", opts...); err == nil {
+		t.Fatal("expected User= to be rejected in user mode")
+	}
+	spec := placeholder.systemd.spec
+	if placeholder.created || placeholder.root.Use != "" || placeholder.remoteConfig || spec.user ||
+		spec.config["Service"]["User"] != "" || spec.config["Service"]["Nice"] != "5" {
+		t.Errorf("expected a failed New to leave the placeholder as it was, got %q %+v", placeholder.root.Use, spec)
+	}
+	if d, err := New("svc", opts[:2]...); err != nil || d != placeholder || d.root.PersistentFlags().Lookup("remote-endpoint") == nil {
+		t.Fatalf("expected the placeholder to be adopted with the remote flags, got %v", err)
+	}
+	std = nil
+
+	d, err := New("svc", WithVersion("1.0.0", "abc"), WithUserMode(), WithHardening(HardeningBasic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.root.Version != "svc 1.0.0 abc" {
+		t.Errorf("unexpected version %q", d.root.Version)
+	}
+	buf, err := d.systemd.spec.createUnit(true, d.systemd.Name, "", "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateUnit(buf); err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{"PIDFile=%t/svc@%i.pid\n", "systemctl --user show", "WantedBy=default.target\n"} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("expected %q in user unit:\n%s", want, buf)
+		}
+	}
+	d.root.SetArgs([]string{"install", "--dry-run", "--hardening", HardeningStrict})
+	d.root.SilenceUsage, d.root.SilenceErrors = true, true
+	if err = d.root.Execute(); err == nil || !strings.Contains(err.Error(), "DynamicUser") {
+		t.Errorf("expected install --hardening %s to be rejected in user mode, got %v", HardeningStrict, err)
+	}
+	t.Setenv("HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	if dir, err := d.systemd.unitDir(); err == nil {
+		t.Errorf("expected an error without a user config directory, got %s", dir)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	resetDefault(t)
+	type apiConfig struct {
+		Port int    `json:"port" default:"8080"`
+		Host string `json:"host" default:"localhost"`
+	}
+	var api apiConfig
+	ran := make(chan string, 2)
+	action := func(name string) ActionFunc {
+		return func(_ *cobra.Command, _ []string) error {
+			ran <- name
+			return nil
+		}
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config_default.json"), []byte(`{"api":{"port":9000}}`), 0644)
+	d, err := New("app", WithConfigPaths(dir),
+		WithComponent(Component{Name: "api", Action: action("api"), Config: &api}),
+		WithComponent(Component{Name: "worker", Description: "Worker", Action: action("worker")}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.AddComponent(Component{Name: "api", Action: action("api")}); err == nil {
+		t.Error("expected a duplicate component to be rejected")
+	}
+
+	d.root.SetArgs([]string{"--component", "api"})
+	if err = d.ExecuteE(nil); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-ran; name != "api" || api.Port != 9000 || api.Host != "localhost" {
+		t.Errorf("expected the api component with its config section, got %s %+v", name, api)
+	}
+	d.root.SetArgs([]string{"run-all"})
+	if err = d.ExecuteE(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{<-ran, <-ran}; !slices.Contains(got, "api") || !slices.Contains(got, "worker") {
+		t.Errorf("expected both components to run, got %v", got)
+	}
+	d.root.PersistentFlags().Set("component", "")
+	d.root.SetArgs([]string{})
+	if err = d.ExecuteE(nil); err == nil || !strings.Contains(err.Error(), "run-all") {
+		t.Errorf("expected an error without --component, got %v", err)
+	}
+
+	failed := errors.New("failed")
+	e, err := New("app2", WithConfigPaths(dir),
+		WithComponent(Component{Name: "bad", Action: func(*cobra.Command, []string) error { return failed }}),
+		WithComponent(Component{Name: "good", Action: func(cmd *cobra.Command, _ []string) error {
+			<-cmd.Context().Done()
+			return nil
+		}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.root.SetArgs([]string{"run-all"})
+	if err = e.ExecuteE(nil); !errors.Is(err, failed) {
+		t.Errorf("expected a failed component to stop run-all, got %v", err)
+	}
+
+	services := d.systemd.services()
+	if len(services) != 2 || services[0].Name != "app-api" || services[1].Description != "Worker" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+	buf, err := services[0].spec.createUnit(true, services[0].Name, "", "/bin/sh", services[0].args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "ExecStart=/bin/sh --instance %i --component api\n") {
+		t.Errorf("expected the component in ExecStart:\n%s", buf)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	resetDefault(t)
+	var (
+		mu     sync.Mutex
+		phases []string
+	)
+	record := func(p string) {
+		mu.Lock()
+		phases = append(phases, p)
+		mu.Unlock()
+	}
+	hook := func(p Phase) Option {
+		return WithHook(p, func(*cobra.Command) error {
+			record(string(p))
+			return nil
+		})
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config_default.json"), []byte(`{}`), 0644)
+	d, err := New("hooked", WithConfigPaths(dir),
+		hook(HookConfigLoaded), hook(HookPreStart), hook(HookPostStart), hook(HookPreStop), hook(HookPostStop),
+		WithWorker(Worker{Name: "once", Restart: RestartNever, Run: func(context.Context) error {
+			record("worker")
+			return nil
+		}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.AddHook("pre-flight", func(*cobra.Command) error { return nil }); err == nil {
+		t.Error("expected an unknown phase to be rejected")
+	}
+	d.root.SetArgs([]string{})
+	if err = d.ExecuteE(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"config-loaded", "pre-start", "post-start", "worker", "pre-stop", "post-stop"}
+	if !slices.Equal(phases, want) && !slices.Equal(phases, []string{"config-loaded", "pre-start", "worker", "post-start", "pre-stop", "post-stop"}) {
+		t.Errorf("expected the phases %v, got %v", want, phases)
+	}
+
+	phases = nil
+	d.AddHook(HookPreStart, func(*cobra.Command) error { return errors.New("not ready") })
+	err = d.ExecuteE(func(*cobra.Command, []string) error {
+		record("action")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "pre-start hook: not ready") || slices.Contains(phases, "action") {
+		t.Errorf("expected a failing pre-start hook to skip the action, got %v %v", err, phases)
+	}
+
+	// A signal runs the pre-stop hooks and cancels the context of the action
+	d.hooks[HookPreStart] = d.hooks[HookPreStart][:1]
+	phases = nil
+	err = d.ExecuteE(func(cmd *cobra.Command, _ []string) error {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		select {
+		case <-cmd.Context().Done():
+			record("action")
+		case <-time.After(5 * time.Second):
+		}
+		return nil
+	})
+	want = []string{"config-loaded", "pre-start", "pre-stop", "action", "post-stop"}
+	if err != nil || !slices.Equal(phases, want) && !slices.Equal(phases, []string{"config-loaded", "pre-start", "action", "pre-stop", "post-stop"}) {
+		t.Errorf("expected the phases %v, got %v %v", want, phases, err)
+	}
+
+	// The install and remove commands load the config for their hooks
+	os.WriteFile(filepath.Join(dir, "config_default.json"), []byte(`{"region":"eu"}`), 0644)
+	var region string
+	d.AddHook(HookPreRemove, func(*cobra.Command) error {
+		region = d.v.GetString("region")
+		return nil
+	})
+	cmd := &cobra.Command{}
+	cmd.Flags().String("instance", "default", "")
+	cmd.Flags().String("config", "", "")
+	if err = d.installHooks(cmd, HookPreRemove); err == nil {
+		t.Error("expected the pre-remove hook not to run without its config")
+	}
+	if err = d.loadInstallHooks(cmd, HookPreRemove); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.installHooks(cmd, HookPreRemove); err != nil || region != "eu" {
+		t.Errorf("expected the config in the pre-remove hook, got %q %v", region, err)
+	}
+}
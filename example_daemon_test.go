@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"github.com/virzz/daemon/v2"
 	"github.com/virzz/vlog"
@@ -39,7 +38,7 @@ func Action(cmd *cobra.Command, args []string) error {
 		select {
 		case <-time.After(2 * time.Second):
 			log.Println("Myservice is running...")
-			log.Printf("%+v\n", viper.AllSettings())
+			log.Printf("%+v\n", C)
 		case killSignal := <-interrupt:
 			fmt.Println("Got signal:", killSignal)
 			if killSignal == os.Interrupt {
@@ -52,20 +51,22 @@ func Action(cmd *cobra.Command, args []string) error {
 }
 
 func Example() {
-	_, err := daemon.New(appID, name, description, Version, Commit)
+	vlog.New("test.log")
+	d, err := daemon.New(name,
+		daemon.WithAppID(appID),
+		daemon.WithDescription(description),
+		daemon.WithVersion(Version, Commit),
+		daemon.WithLogger(vlog.Log),
+		daemon.WithConfig(C),
+		daemon.WithRemoteConfig("test"),
+		daemon.WithUnitOption("Service", "Type", "simple"),
+	)
 	if err != nil {
 		fmt.Println("Error: ", err)
 		os.Exit(1)
 	}
-	vlog.New("test.log")
-	daemon.SetLogger(vlog.Log)
-
-	daemon.EnableRemoteConfig("test")
-
-	daemon.SetUnitConfig("Service", "Type", "simple")
-	daemon.RegisterConfig(C)
 
-	err = daemon.ExecuteE(Action)
+	err = d.ExecuteE(Action)
 	if err != nil {
 		fmt.Println("Error: ", err)
 	}
@@ -0,0 +1,227 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Headers identifying the daemon to the config server
+const (
+	RemoteInstanceHeader = "X-Virzz-Instance"
+	RemoteHostnameHeader = "X-Virzz-Hostname"
+	RemoteVersionHeader  = "X-Virzz-Version"
+)
+
+// RemoteOptions configures how the remote config is fetched
+type RemoteOptions struct {
+	PublicKeys []string
+	Endpoint   string
+	// KeyTemplates are the remote keys tried in order, DefaultRemoteKeys if empty
+	KeyTemplates []string
+	Timeout      time.Duration
+	// Retries is the number of retries after a failed request,
+	// waiting RetryWait doubled on every attempt up to RetryMaxWait, with jitter
+	Retries      int
+	RetryWait    time.Duration
+	RetryMaxWait time.Duration
+	CAFile       string
+	CertFile     string
+	KeyFile      string
+	Proxy        string
+	Headers      map[string]string
+}
+
+type RemoteOption func(*RemoteOptions)
+
+// RemotePublicKey sets the PEM encoded public keys of the config server,
+// several keys may be given during a key rotation
+func RemotePublicKey(keys ...string) RemoteOption {
+	return func(o *RemoteOptions) { o.PublicKeys = append(o.PublicKeys, keys...) }
+}
+
+// RemoteEndpoint sets the default config server, overridden by --remote-endpoint
+func RemoteEndpoint(endpoint string) RemoteOption {
+	return func(o *RemoteOptions) { o.Endpoint = endpoint }
+}
+
+// RemoteKeys sets the templates of the remote keys tried in order until a config is found,
+// see DefaultRemoteKeys for the placeholders
+func RemoteKeys(templates ...string) RemoteOption {
+	return func(o *RemoteOptions) { o.KeyTemplates = templates }
+}
+
+// RemoteTimeout sets the timeout of a single request
+func RemoteTimeout(d time.Duration) RemoteOption {
+	return func(o *RemoteOptions) { o.Timeout = d }
+}
+
+// RemoteRetry retries failed requests with exponential backoff starting at wait
+func RemoteRetry(retries int, wait, maxWait time.Duration) RemoteOption {
+	return func(o *RemoteOptions) { o.Retries, o.RetryWait, o.RetryMaxWait = retries, wait, maxWait }
+}
+
+// RemoteCAFile trusts the PEM encoded CA bundle in addition to the system roots
+func RemoteCAFile(fn string) RemoteOption {
+	return func(o *RemoteOptions) { o.CAFile = fn }
+}
+
+// RemoteClientCert authenticates to the config server with a client certificate
+func RemoteClientCert(certFile, keyFile string) RemoteOption {
+	return func(o *RemoteOptions) { o.CertFile, o.KeyFile = certFile, keyFile }
+}
+
+// RemoteProxy sends requests through the proxy instead of the one from the environment
+func RemoteProxy(proxy string) RemoteOption {
+	return func(o *RemoteOptions) { o.Proxy = proxy }
+}
+
+// RemoteHeader adds a header to every request
+func RemoteHeader(name, value string) RemoteOption {
+	return func(o *RemoteOptions) {
+		if o.Headers == nil {
+			o.Headers = make(map[string]string)
+		}
+		o.Headers[name] = value
+	}
+}
+
+func defaultRemoteOptions() RemoteOptions {
+	return RemoteOptions{
+		Timeout:      10 * time.Second,
+		Retries:      3,
+		RetryWait:    500 * time.Millisecond,
+		RetryMaxWait: 10 * time.Second,
+	}
+}
+
+// addRemoteFlags registers the --remote-* flags with the options as defaults
+func addRemoteFlags(cmd *cobra.Command, o *RemoteOptions) {
+	flags := cmd.PersistentFlags()
+	flags.Duration("remote-timeout", o.Timeout, "Remote config request timeout")
+	flags.Int("remote-retries", o.Retries, "Remote config request retries")
+	flags.String("remote-ca-file", o.CAFile, "CA bundle of the remote config server")
+	flags.String("remote-cert", o.CertFile, "Client certificate for the remote config server")
+	flags.String("remote-key", o.KeyFile, "Client certificate key for the remote config server")
+	flags.String("remote-proxy", o.Proxy, "Proxy for the remote config server")
+	flags.StringArray("remote-header", nil, "Extra header for the remote config server, as Name=Value")
+	flags.StringSlice("remote-key-template", o.KeyTemplates, "Remote keys tried in order, with placeholders {project}, {app}, {version}, {major}, {instance}, {hostname} and {env}")
+}
+
+// remoteOptionsFromFlags returns a copy of the options overridden by the changed flags
+func remoteOptionsFromFlags(cmd *cobra.Command, o RemoteOptions) (RemoteOptions, error) {
+	flags := cmd.Flags()
+	changed := func(name string) bool { f := flags.Lookup(name); return f != nil && f.Changed }
+	if changed("remote-timeout") {
+		o.Timeout, _ = flags.GetDuration("remote-timeout")
+	}
+	if changed("remote-retries") {
+		o.Retries, _ = flags.GetInt("remote-retries")
+	}
+	if changed("remote-ca-file") {
+		o.CAFile, _ = flags.GetString("remote-ca-file")
+	}
+	if changed("remote-cert") {
+		o.CertFile, _ = flags.GetString("remote-cert")
+	}
+	if changed("remote-key") {
+		o.KeyFile, _ = flags.GetString("remote-key")
+	}
+	if changed("remote-proxy") {
+		o.Proxy, _ = flags.GetString("remote-proxy")
+	}
+	if changed("remote-key-template") {
+		o.KeyTemplates, _ = flags.GetStringSlice("remote-key-template")
+		for _, tmpl := range o.KeyTemplates {
+			if err := checkKeyTemplate(tmpl); err != nil {
+				return o, err
+			}
+		}
+	}
+	headers := make(map[string]string, len(o.Headers))
+	for k, v := range o.Headers {
+		headers[k] = v
+	}
+	if changed("remote-header") {
+		values, _ := flags.GetStringArray("remote-header")
+		for _, h := range values {
+			name, value, ok := strings.Cut(h, "=")
+			if !ok || name == "" {
+				return o, errors.Errorf("invalid remote header %q, expected Name=Value", h)
+			}
+			headers[name] = value
+		}
+	}
+	o.Headers = headers
+	return o, nil
+}
+
+// client builds the HTTP client of the options
+func (o *RemoteOptions) client() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if o.Proxy != "" {
+		proxy, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "remote proxy")
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if o.CAFile != "" || o.CertFile != "" {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		buf, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, errors.Errorf("no certificates found in %s", o.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		keyFile := o.KeyFile
+		if keyFile == "" {
+			keyFile = o.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "remote client certificate")
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: o.Timeout, Transport: transport}, nil
+}
+
+// backoff returns the wait before retry attempt n, starting at 0
+func (o *RemoteOptions) backoff(n int) time.Duration {
+	if o.RetryWait <= 0 {
+		return 0
+	}
+	limit := time.Duration(math.MaxInt64)
+	if o.RetryMaxWait > 0 {
+		limit = o.RetryMaxWait
+	}
+	// Clamp before shifting, a shifted wait overflows
+	wait := o.RetryWait
+	if shift := min(n, 62); wait > limit>>shift {
+		wait = limit
+	} else {
+		wait <<= shift
+	}
+	// Jitter keeps instances restarted together from retrying in lockstep
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
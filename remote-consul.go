@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("consul", func(o *ProviderOptions) (ConfigProvider, error) {
+		return &consulProvider{o}, nil
+	}, "consul", "consuls")
+}
+
+// consulProvider reads <prefix>/<key> from the Consul KV store,
+// e.g. consul://127.0.0.1:8500/prefix?dc=dc1&token=..., consuls:// uses https.
+// The token defaults to $CONSUL_HTTP_TOKEN.
+type consulProvider struct{ o *ProviderOptions }
+
+func (p *consulProvider) Fetch(ctx context.Context, key string) ([]byte, string, error) {
+	query := p.o.Endpoint.Query()
+	token := query.Get("token")
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	query.Del("token")
+	query.Set("raw", "")
+	target := url.URL{
+		Scheme:   "http",
+		Host:     p.o.Endpoint.Host,
+		Path:     "/v1/kv/" + strings.TrimPrefix(joinKey(p.o.Endpoint.Path, key), "/"),
+		RawQuery: query.Encode(),
+	}
+	if p.o.Endpoint.Scheme == "consuls" {
+		target.Scheme = "https"
+	}
+	header := make(http.Header)
+	if token != "" {
+		header.Set("X-Consul-Token", token)
+	}
+	buf, _, err := httpGet(ctx, p.o, target.String(), header)
+	// Consul answers raw values as application/octet-stream, the format is unknown
+	return buf, "", err
+}
@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	RegisterProvider("file", func(o *ProviderOptions) (ConfigProvider, error) {
+		return &fileProvider{filepath.FromSlash(o.Endpoint.Path)}, nil
+	}, "file")
+}
+
+var fileContentTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+}
+
+// fileProvider reads <dir>/<key> or <dir>/<key>.<ext> from a local directory,
+// e.g. a mounted volume, the format is taken from the extension
+type fileProvider struct{ dir string }
+
+func (p *fileProvider) Fetch(_ context.Context, key string) ([]byte, string, error) {
+	fn := filepath.Join(p.dir, filepath.FromSlash(key))
+	for _, name := range []string{fn, fn + ".json", fn + ".yaml", fn + ".yml", fn + ".toml"} {
+		if fi, err := os.Stat(name); err != nil || fi.IsDir() {
+			continue
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return nil, "", err
+		}
+		return buf, fileContentTypes[filepath.Ext(name)], nil
+	}
+	return nil, "", ErrConfigNotFound
+}
@@ -0,0 +1,26 @@
+package daemon
+
+import (
+	"context"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("http", func(o *ProviderOptions) (ConfigProvider, error) {
+		return &httpProvider{o}, nil
+	}, "plain+http", "plain+https")
+}
+
+// httpProvider gets plain config from <endpoint>/<key>, the format is taken from the Content-Type,
+// e.g. plain+https://config.example.com/configs. Plain http(s):// endpoints speak the virzz protocol.
+type httpProvider struct{ o *ProviderOptions }
+
+func (p *httpProvider) Fetch(ctx context.Context, key string) ([]byte, string, error) {
+	target := *p.o.Endpoint
+	target.Scheme = strings.TrimPrefix(target.Scheme, "plain+")
+	if target.Scheme == "" {
+		target.Scheme = "https"
+	}
+	target.Path = joinKey(target.Path, key)
+	return httpGet(ctx, p.o, target.String(), nil)
+}
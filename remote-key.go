@@ -0,0 +1,105 @@
+package daemon
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRemoteKeys are the remote keys tried in order until a config is found:
+// the exact version, the major version, the latest version and the default instance.
+// Placeholders are {project}, {app}, {version}, {major}, {instance}, {hostname} and {env}.
+var DefaultRemoteKeys = []string{
+	"/{project}/{app}/{version}/{instance}",
+	"/{project}/{app}/{major}/{instance}",
+	"/{project}/{app}/latest/{instance}",
+	"/{project}/{app}/latest/default",
+}
+
+// envRemoteKeys are the DefaultRemoteKeys of an env profile
+var envRemoteKeys = []string{
+	"/{project}/{app}/{version}/{instance}.{env}",
+	"/{project}/{app}/{major}/{instance}.{env}",
+	"/{project}/{app}/latest/{instance}.{env}",
+	"/{project}/{app}/latest/default.{env}",
+}
+
+var keyPlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+var keyVars = []string{"project", "app", "version", "major", "instance", "hostname", "env"}
+
+// checkKeyTemplate reports unknown placeholders of a key template
+func checkKeyTemplate(tmpl string) error {
+	for _, m := range keyPlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		if !slices.Contains(keyVars, m[1]) {
+			return errors.Errorf("unknown placeholder %s in remote key %s, expected one of: {%s}", m[0], tmpl, strings.Join(keyVars, "}, {"))
+		}
+	}
+	return nil
+}
+
+// majorVersion returns the major part of a version, e.g. v1 of v1.2.3
+func majorVersion(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+// expandKeys fills the placeholders of the templates, skipping templates with an empty
+// placeholder, e.g. the version ones of a daemon without version, and keys already listed,
+// e.g. when the instance is the default one. A value must stay within its key segment.
+func expandKeys(templates []string, vars map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(templates))
+	for _, tmpl := range templates {
+		var (
+			empty bool
+			err   error
+		)
+		key := keyPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+			v := vars[m[1:len(m)-1]]
+			switch {
+			case v == "":
+				empty = true
+			case strings.Contains(v, "/") || v == "." || v == "..":
+				err = errors.Errorf("invalid value %q of %s in remote key %s", v, m, tmpl)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			continue
+		}
+		key = path.Clean("/" + key)
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// remotePaths returns the remote keys to try for the instance. With an env profile
+// the default keys name the instance <instance>.<env>, configs without the profile
+// are not used so that e.g. prod never falls back to a config meant for another env.
+func (d *Daemon) remotePaths(templates []string, instance, env string) ([]string, error) {
+	if len(templates) == 0 {
+		templates = DefaultRemoteKeys
+		if env != "" {
+			templates = envRemoteKeys
+		}
+	}
+	hostname, _ := os.Hostname()
+	return expandKeys(templates, map[string]string{
+		"project":  d.project,
+		"app":      d.systemd.AppID,
+		"version":  d.systemd.Version,
+		"major":    majorVersion(d.systemd.Version),
+		"instance": instance,
+		"hostname": hostname,
+		"env":      env,
+	})
+}
@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RemoteProtocol is the version of the remote config protocol spoken by RemoteProvider.
+//
+// The client posts a RemoteRequest carrying the session secret encrypted with
+// RSA-OAEP(SHA-256) for every known server key, a random nonce and a timestamp.
+// The server answers with the config sealed with AES-GCM under the session secret,
+// authenticated together with the protocol version, the key path, the nonce and
+// the timestamp of the request, so that a response can't be replayed for another request,
+// and with its Content-Type, which selects the parser of the config.
+const RemoteProtocol = 2
+
+// RemoteProtocolHeader carries the protocol version of requests and responses
+const RemoteProtocolHeader = "X-Virzz-Protocol"
+
+// RemoteMaxSkew is the maximum age of a request accepted by the server
+const RemoteMaxSkew = 5 * time.Minute
+
+// RemoteRequest is the body posted to the config server
+type RemoteRequest struct {
+	Version   int          `json:"v"`
+	Keys      []WrappedKey `json:"keys"`
+	Nonce     []byte       `json:"nonce"`
+	Timestamp int64        `json:"ts"`
+}
+
+// WrappedKey is the session secret encrypted with the server key identified by ID
+type WrappedKey struct {
+	ID  string `json:"kid"`
+	Key []byte `json:"key"`
+}
+
+// KeyID identifies a RSA key by the hash of its public part
+func KeyID(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParsePublicKey decodes a PEM encoded RSA public key
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("Failed to decode PEM block containing public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return key, nil
+}
+
+// WrapKey encrypts the session secret for every public key
+func WrapKey(secret []byte, keys ...*rsa.PublicKey) ([]WrappedKey, error) {
+	wrapped := make([]WrappedKey, 0, len(keys))
+	for _, key := range keys {
+		data, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, secret, nil)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = append(wrapped, WrappedKey{ID: KeyID(key), Key: data})
+	}
+	return wrapped, nil
+}
+
+// NewRemoteRequest returns a request with a fresh nonce and the current time
+func NewRemoteRequest(keys []WrappedKey) (*RemoteRequest, error) {
+	r := &RemoteRequest{Version: RemoteProtocol, Keys: keys, Nonce: make([]byte, 16), Timestamp: time.Now().Unix()}
+	if _, err := io.ReadFull(rand.Reader, r.Nonce); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Check verifies the version, nonce and age of a request
+func (r *RemoteRequest) Check(now time.Time) error {
+	if r.Version != RemoteProtocol {
+		return errors.Errorf("unsupported protocol version %d", r.Version)
+	}
+	if len(r.Nonce) != 16 {
+		return errors.New("invalid nonce")
+	}
+	if d := now.Sub(time.Unix(r.Timestamp, 0)); d > RemoteMaxSkew || d < -RemoteMaxSkew {
+		return errors.New("request expired")
+	}
+	return nil
+}
+
+// Unwrap decrypts the session secret with the first matching private key
+func (r *RemoteRequest) Unwrap(keys ...*rsa.PrivateKey) ([]byte, error) {
+	for _, key := range keys {
+		id := KeyID(&key.PublicKey)
+		for _, w := range r.Keys {
+			if w.ID == id {
+				return rsa.DecryptOAEP(sha256.New(), rand.Reader, key, w.Key, nil)
+			}
+		}
+	}
+	return nil, errors.New("no known key")
+}
+
+// Seal encrypts the config answering the request for path, sent with the Content-Type
+func (r *RemoteRequest) Seal(secret []byte, path, contentType string, data []byte) ([]byte, error) {
+	return sealGCM(secret, data, r.aad(path, contentType))
+}
+
+// Open decrypts and authenticates the response to the request for path and its Content-Type
+func (r *RemoteRequest) Open(secret []byte, path, contentType string, data []byte) ([]byte, error) {
+	buf, err := openGCM(secret, data, r.aad(path, contentType))
+	if err != nil {
+		return nil, errors.New("invalid remote config, authentication failed")
+	}
+	return buf, nil
+}
+
+// aad binds a response to the protocol version, the request, the path and the Content-Type
+func (r *RemoteRequest) aad(path, contentType string) []byte {
+	buf := make([]byte, 0, 32+len(r.Nonce)+len(path)+len(contentType))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(r.Version))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.Timestamp))
+	buf = append(buf, r.Nonce...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(path)))
+	buf = append(buf, path...)
+	return append(buf, contentType...)
+}
+
+// ReplayCache rejects requests whose nonce was already seen within RemoteMaxSkew,
+// older requests are rejected by their timestamp
+type ReplayCache struct {
+	// Max bounds the nonces kept, requests are rejected while it is reached, 100000 if 0
+	Max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+	// order holds the nonces in the order they were seen, they expire from the front
+	order []replayEntry
+}
+
+type replayEntry struct {
+	nonce string
+	seen  time.Time
+}
+
+// Check verifies the timestamp of the request and records its nonce. It is called once
+// the request is authenticated, so that unauthenticated clients can't fill the cache.
+func (c *ReplayCache) Check(r *RemoteRequest, now time.Time) error {
+	if err := r.Check(now); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]struct{})
+	}
+	expired := 0
+	for expired < len(c.order) && now.Sub(c.order[expired].seen) > 2*RemoteMaxSkew {
+		delete(c.seen, c.order[expired].nonce)
+		expired++
+	}
+	c.order = c.order[expired:]
+	if _, ok := c.seen[string(r.Nonce)]; ok {
+		return errors.New("request replayed")
+	}
+	max := c.Max
+	if max <= 0 {
+		max = 100000
+	}
+	if len(c.order) >= max {
+		return errors.New("too many requests")
+	}
+	c.seen[string(r.Nonce)] = struct{}{}
+	c.order = append(c.order, replayEntry{string(r.Nonce), now})
+	return nil
+}
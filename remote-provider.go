@@ -2,63 +2,120 @@ package daemon
 
 import (
 	"bytes"
-	"crypto/aes"
+	"context"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
-
-	"github.com/virzz/utils/crypto"
 )
 
+func init() {
+	RegisterProvider("virzz", func(o *ProviderOptions) (ConfigProvider, error) {
+		return &RemoteProvider{
+			Keys:     o.Keys,
+			Secret:   o.Secret,
+			Endpoint: o.Endpoint.String(),
+			Headers:  o.Headers,
+			Client:   o.Client,
+			logger:   o.Logger,
+		}, nil
+	}, "virzz")
+}
+
+// RemoteProvider speaks the encrypted virzz protocol, see RemoteProtocol
 type RemoteProvider struct {
 	viper.RemoteProvider
-	EncryptSecret []byte
-	TargetURL     string
-	logger        *slog.Logger
+	Keys     []WrappedKey
+	Secret   []byte
+	Endpoint string
+	Headers  map[string]string
+	Client   *http.Client
+	logger   *slog.Logger
 }
 
 func (c *RemoteProvider) Get(rp viper.RemoteProvider) (io.Reader, error) {
 	c.RemoteProvider = rp
-	if c.TargetURL == "" {
-		target, err := url.Parse(rp.Endpoint())
-		if err != nil {
-			return nil, err
-		}
-		if target.Host == "" {
-			target.Host = defaultRemoteEndpoint
-		}
-		if target.Scheme == "" {
-			target.Scheme = "https"
-		}
-		target.Path = rp.Path()
-		c.TargetURL = target.String()
+	c.Endpoint, c.Secret = rp.Endpoint(), []byte(rp.SecretKeyring())
+	buf, _, err := c.Fetch(context.Background(), rp.Path())
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
+
+// targetURL returns the URL of key, the endpoint defaults to https://config.app.virzz.com
+func (c *RemoteProvider) targetURL(key string) (string, error) {
+	target, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	if target.Host == "" {
+		// A bare host name is parsed as a path
+		target.Host, target.Path = target.Path, ""
+	}
+	if target.Host == "" {
+		target.Host = defaultRemoteEndpoint
+	}
+	if target.Scheme == "" || target.Scheme == "virzz" {
+		target.Scheme = "https"
+	}
+	target.Path = joinKey(target.Path, key)
+	return target.String(), nil
+}
+
+// Fetch requests the config of key once and returns it decrypted
+// along with the Content-Type the server sent for it, authenticated with the config
+func (c *RemoteProvider) Fetch(ctx context.Context, key string) ([]byte, string, error) {
+	target, err := c.targetURL(key)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := NewRemoteRequest(c.Keys)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	for name, value := range c.Headers {
+		hreq.Header.Set(name, value)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Accept", "application/json, application/yaml, application/toml")
+	hreq.Header.Set(RemoteProtocolHeader, strconv.Itoa(RemoteProtocol))
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
 	}
 	// Get remote config
-	rsp, err := http.Post(c.TargetURL, "application/object-stream", bytes.NewBuffer(c.EncryptSecret))
+	rsp, err := client.Do(hreq)
 	if err != nil {
-		c.logger.Error("Failed to request remote", "err", err.Error())
-		return nil, err
+		return nil, "", err
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("Failed to get remote config: %s", rsp.Status)
-	}
-	buf, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
+		return nil, "", &StatusError{Code: rsp.StatusCode, Status: rsp.Status}
 	}
-	if len(buf) < aes.BlockSize {
-		return nil, errors.New("invalid remote config")
+	if v := rsp.Header.Get(RemoteProtocolHeader); v != strconv.Itoa(RemoteProtocol) {
+		return nil, "", errors.Errorf("Unsupported remote protocol version %q, expected %d", v, RemoteProtocol)
 	}
-	buf, err = crypto.AesDecrypt(buf[aes.BlockSize:], []byte(rp.SecretKeyring()), buf[:aes.BlockSize])
+	buf, err := io.ReadAll(rsp.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return bytes.NewReader(buf), nil
+	contentType := rsp.Header.Get("Content-Type")
+	buf, err = req.Open(c.Secret, key, contentType, buf)
+	return buf, contentType, err
 }
 
 func (c *RemoteProvider) Watch(rp viper.RemoteProvider) (io.Reader, error) {
@@ -0,0 +1,379 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type testRemote struct{ endpoint, path, secret string }
+
+func (r testRemote) Provider() string      { return "virzz" }
+func (r testRemote) Endpoint() string      { return r.endpoint }
+func (r testRemote) Path() string          { return r.path }
+func (r testRemote) SecretKeyring() string { return r.secret }
+
+func TestRemoteProtocol(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var last []byte
+	srv := httptest.NewServer(testRemoteHandler(newKey, "application/json", `{"a":1}`, func(body []byte) { last = body }))
+	defer srv.Close()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	keys, err := WrapKey(secret, &oldKey.PublicKey, &newKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := testRemote{srv.URL, "/p/app/1.0.0/default", string(secret)}
+	p := &RemoteProvider{Keys: keys, logger: slog.Default()}
+	r, err := p.Get(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := io.ReadAll(r); string(buf) != `{"a":1}` {
+		t.Errorf("unexpected config %s", buf)
+	}
+
+	rsp, _ := http.Post(srv.URL+rp.path, "application/json", bytes.NewReader(last))
+	if rsp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a replayed request to be rejected, got %s", rsp.Status)
+	}
+	rsp.Body.Close()
+
+	// A response must not be accepted for another request
+	req, _ := NewRemoteRequest(keys)
+	sealed, _ := req.Seal(secret, rp.path, "application/json", []byte(`{"a":2}`))
+	other, _ := NewRemoteRequest(keys)
+	if _, err = other.Open(secret, rp.path, "application/json", sealed); err == nil {
+		t.Error("expected a response for another request to be rejected")
+	}
+	if _, err = req.Open(secret, "/p/app/1.0.0/other", "application/json", sealed); err == nil {
+		t.Error("expected a response for another path to be rejected")
+	}
+	if _, err = req.Open(secret, rp.path, "application/yaml", sealed); err == nil {
+		t.Error("expected a response with another Content-Type to be rejected")
+	}
+	req.Timestamp -= int64(2 * RemoteMaxSkew / time.Second)
+	if err = req.Check(time.Now()); err == nil {
+		t.Error("expected an expired request to be rejected")
+	}
+}
+
+// testRemoteHandler serves payload to every valid request with the given server key
+func testRemoteHandler(key *rsa.PrivateKey, contentType, payload string, onRequest func(body []byte)) http.Handler {
+	var replay ReplayCache
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if onRequest != nil {
+			onRequest(body)
+		}
+		var req RemoteRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		secret, err := req.Unwrap(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := replay.Check(&req, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		buf, _ := req.Seal(secret, r.URL.Path, contentType, []byte(payload))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set(RemoteProtocolHeader, strconv.Itoa(RemoteProtocol))
+		w.Write(buf)
+	})
+}
+
+// newRemoteTestDaemon returns a daemon of app 1.0.0 requiring the remote config of project p,
+// keeping its state in a temporary directory
+func newRemoteTestDaemon(t *testing.T, keys ...*rsa.PublicKey) *Daemon {
+	t.Helper()
+	t.Setenv("STATE_DIRECTORY", t.TempDir())
+	return &Daemon{
+		v:            viper.New(),
+		root:         &cobra.Command{Use: "test"},
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		systemd:      &Systemd{Name: "test", AppID: "app", Version: "1.0.0"},
+		project:      "p",
+		remoteKeys:   keys,
+		remotePolicy: RemoteRequired,
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := httptest.NewServer(testRemoteHandler(key, "application/json", `{"a":1}`, nil))
+	d := newRemoteTestDaemon(t, &key.PublicKey)
+	// The state directory is created on the first write, the cache key is the config key
+	state := filepath.Join(os.Getenv("STATE_DIRECTORY"), "new")
+	t.Setenv("STATE_DIRECTORY", state)
+	t.Setenv("TEST_CONFIG_KEY", strings.Repeat("ab", 32))
+	cmd := &cobra.Command{}
+	cmd.Flags().String("remote-endpoint", srv.URL, "")
+
+	layer, err := d.readRemote(cmd, "default", "")
+	if err != nil || layer == nil {
+		t.Fatalf("expected the remote config, got %v %v", layer, err)
+	}
+	if _, err = os.Stat(filepath.Join(state, "remote_default.cache")); err != nil {
+		t.Fatalf("expected the remote config to be cached, got %v", err)
+	}
+	secret := d.secretKey
+	srv.Close()
+
+	// A restarted daemon reuses the session secret and falls back to the cache
+	d.secretKey = nil
+	layer, err = d.readRemote(cmd, "default", "")
+	if err != nil || layer == nil || !strings.HasPrefix(layer.Source, "cache ") || layer.Values["a"] != float64(1) {
+		t.Fatalf("expected the cached remote config, got %v %v", layer, err)
+	}
+	if !bytes.Equal(secret, d.secretKey) {
+		t.Error("expected the session secret to be persisted")
+	}
+	t.Setenv("TEST_CONFIG_KEY", strings.Repeat("cd", 32))
+	if layer, err = d.readRemote(cmd, "default", ""); err == nil {
+		t.Errorf("expected the cache not to open with another key, got %v", layer)
+	}
+	if _, err = d.readRemote(cmd, "other", ""); err == nil {
+		t.Error("expected an error without remote config and cache")
+	}
+	d.remotePolicy = RemotePreferred
+	if layer, err = d.readRemote(cmd, "other", ""); err != nil || layer != nil {
+		t.Errorf("expected no remote config, got %v %v", layer, err)
+	}
+}
+
+func TestRemoteRetry(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	handler := testRemoteHandler(key, "application/json", `{"a":1}`, nil)
+	var calls int
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		header = r.Header
+		if calls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d := newRemoteTestDaemon(t, &key.PublicKey)
+	d.remoteOptions = RemoteOptions{Timeout: time.Second, Retries: 2, RetryWait: time.Millisecond}
+	cmd := &cobra.Command{}
+	cmd.Flags().String("remote-endpoint", srv.URL, "")
+	addRemoteFlags(cmd, &d.remoteOptions)
+	cmd.ParseFlags([]string{"--remote-header", "X-Team=ops"})
+
+	if _, err := d.readRemote(cmd, "web", ""); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 requests, got %d", calls)
+	}
+	if header.Get(RemoteInstanceHeader) != "web" || header.Get(RemoteVersionHeader) != "1.0.0" || header.Get("X-Team") != "ops" {
+		t.Errorf("unexpected headers %v", header)
+	}
+
+	o := RemoteOptions{RetryWait: time.Second, RetryMaxWait: 4 * time.Second}
+	for n, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if wait := o.backoff(n); wait < max/2 || wait > max {
+			t.Errorf("backoff(%d) = %s, expected between %s and %s", n, wait, max/2, max)
+		}
+	}
+	for _, o := range []RemoteOptions{{RetryWait: 10 * time.Second, RetryMaxWait: time.Minute}, {RetryWait: 10 * time.Second}} {
+		for _, n := range []int{0, 3, 30, 100} {
+			if wait := o.backoff(n); wait <= 0 || o.RetryMaxWait > 0 && wait > o.RetryMaxWait {
+				t.Errorf("backoff(%d) with %s = %s", n, o.RetryWait, wait)
+			}
+		}
+	}
+}
+
+func TestRemoteType(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := httptest.NewServer(testRemoteHandler(key, "application/yaml; charset=utf-8", "db:\n  host: remote\n", nil))
+	defer srv.Close()
+	d := newRemoteTestDaemon(t, &key.PublicKey)
+	cmd := &cobra.Command{}
+	cmd.Flags().String("remote-endpoint", srv.URL, "")
+	cmd.Flags().String("remote-type", "json", "")
+	layer, err := d.readRemote(cmd, "default", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := lookupConfig(layer.Values, "db.host"); v != "remote" {
+		t.Errorf("expected db.host from the yaml payload, got %v", layer.Values)
+	}
+	// The flag takes precedence over the Content-Type
+	cmd.ParseFlags([]string{"--remote-type", "toml"})
+	if v, _ := remoteType(cmd, "application/yaml"); v != "toml" {
+		t.Errorf("expected toml, got %s", v)
+	}
+	cmd.ParseFlags([]string{"--remote-type", "ini"})
+	if _, err = remoteType(cmd, ""); err == nil {
+		t.Error("expected an unsupported remote type to fail")
+	}
+	// The provider has a flag of its own
+	cmd.Flags().String("remote-provider", "", "")
+	cmd.ParseFlags([]string{"--remote-type", "json", "--remote-provider", "nope"})
+	if _, err = d.readRemote(cmd, "default", ""); err == nil || !strings.Contains(err.Error(), "unknown remote provider") {
+		t.Errorf("expected the provider of --remote-provider, got %v", err)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "p", "app"), 0755)
+	os.WriteFile(filepath.Join(dir, "p", "app", "default.yaml"), []byte("a: 1\n"), 0644)
+
+	mux := http.NewServeMux()
+	// etcd v3 JSON gateway
+	mux.HandleFunc("/v3/auth/authenticate", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"token":"t0ken"}`))
+	})
+	mux.HandleFunc("/v3/kv/range", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Key []byte }
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Authorization") != "t0ken" || string(req.Key) != "/etcd/p/app/default" {
+			w.Write([]byte(`{"header":{}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"kvs": []map[string][]byte{{"value": []byte(`{"a":1}`)}}})
+	})
+	// Consul KV
+	mux.HandleFunc("/v1/kv/consul/p/app/default", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["raw"]; !ok || r.Header.Get("X-Consul-Token") != "secret" || r.URL.Query().Get("dc") != "dc1" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"a":1}`))
+	})
+	// S3 path style GetObject
+	mux.HandleFunc("/bucket/s3/p/app/default", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AK/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a":1}`))
+	})
+	// Plain HTTP
+	mux.HandleFunc("/http/p/app/default", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/toml")
+		w.Write([]byte("a = 1\n"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct{ name, endpoint, contentType string }{
+		{"", "etcd://root:pass@" + host + "/etcd", ""},
+		{"", "consul://" + host + "/consul?dc=dc1&token=secret", ""},
+		{"", "s3+http://AK:SK@" + host + "/bucket/s3?region=eu-west-1", "application/json"},
+		{"", "plain+http://" + host + "/http", "application/toml"},
+		{"http", "http://" + host + "/http", "application/toml"},
+		{"", "file://" + dir, "application/yaml"},
+	} {
+		endpoint, _ := url.Parse(tc.endpoint)
+		p, err := newProvider(tc.name, &ProviderOptions{Endpoint: endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, contentType, err := p.Fetch(context.Background(), "/p/app/default")
+		if err != nil {
+			t.Errorf("%s: %v", tc.endpoint, err)
+			continue
+		}
+		if contentType != tc.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", tc.endpoint, tc.contentType, contentType)
+		}
+		typ, _ := remoteType(&cobra.Command{}, contentType)
+		if values, err := parseConfig(buf, typ); err != nil || values["a"] == nil {
+			t.Errorf("%s: unexpected config %s %v", tc.endpoint, buf, err)
+		}
+		if _, _, err = p.Fetch(context.Background(), "/p/app/missing"); !errors.Is(err, ErrConfigNotFound) {
+			t.Errorf("%s: expected ErrConfigNotFound, got %v", tc.endpoint, err)
+		}
+	}
+	if _, err := newProvider("nope", &ProviderOptions{}); err == nil {
+		t.Error("expected an unknown provider to fail")
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signV4(req, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestRemoteKeyFallback(t *testing.T) {
+	vars := map[string]string{"project": "p", "app": "app", "version": "v1.2.3", "major": majorVersion("v1.2.3"), "instance": "default"}
+	keys, _ := expandKeys(DefaultRemoteKeys, vars)
+	want := []string{"/p/app/v1.2.3/default", "/p/app/v1/default", "/p/app/latest/default"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("expected %v, got %v", want, keys)
+	}
+	vars["version"], vars["major"] = "", ""
+	if keys, _ = expandKeys(DefaultRemoteKeys, vars); !slices.Equal(keys, want[2:]) {
+		t.Errorf("expected the templates without version to be skipped, got %v", keys)
+	}
+	for _, instance := range []string{"../../other/app/latest/default", "..", "a/b"} {
+		vars["instance"] = instance
+		if _, err := expandKeys(DefaultRemoteKeys, vars); err == nil {
+			t.Errorf("expected the instance %q to be rejected", instance)
+		}
+	}
+	if err := checkKeyTemplate("/{project}/{nope}"); err == nil {
+		t.Error("expected an unknown placeholder to fail")
+	}
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "p", "app", "latest"), 0755)
+	os.WriteFile(filepath.Join(dir, "p", "app", "latest", "default.json"), []byte(`{"a":1}`), 0644)
+	d := newRemoteTestDaemon(t)
+	d.systemd.Version = "1.2.3"
+	cmd := &cobra.Command{}
+	cmd.Flags().String("remote-endpoint", "file://"+dir, "")
+	layer, err := d.readRemote(cmd, "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(layer.Source, "/p/app/latest/default") {
+		t.Errorf("expected the default instance of the latest version, got %s", layer.Source)
+	}
+	os.MkdirAll(filepath.Join(dir, "p", "app", "1"), 0755)
+	os.WriteFile(filepath.Join(dir, "p", "app", "1", "web.json"), []byte(`{"a":2}`), 0644)
+	if layer, err = d.readRemote(cmd, "web", ""); err != nil || layer.Values["a"] != float64(2) {
+		t.Errorf("expected the config of the major version, got %v %v", layer, err)
+	}
+}
@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConfigProvider fetches the raw config stored under a key
+type ConfigProvider interface {
+	// Fetch returns the config and its Content-Type, empty if unknown
+	Fetch(ctx context.Context, key string) ([]byte, string, error)
+}
+
+// ProviderOptions is what a ProviderFactory gets to build a provider
+type ProviderOptions struct {
+	Endpoint *url.URL
+	Client   *http.Client
+	Headers  map[string]string
+	// Keys and Secret are the wrapped and plain session secret of the virzz protocol
+	Keys   []WrappedKey
+	Secret []byte
+	Logger *slog.Logger
+}
+
+type ProviderFactory func(o *ProviderOptions) (ConfigProvider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]ProviderFactory)
+	// providerSchemes maps endpoint URL schemes to providers
+	providerSchemes = make(map[string]string)
+)
+
+// RegisterProvider makes a remote config provider available by name,
+// endpoints with one of the schemes select it
+func RegisterProvider(name string, f ProviderFactory, schemes ...string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = f
+	for _, scheme := range schemes {
+		providerSchemes[scheme] = name
+	}
+}
+
+// Providers lists the registered remote config providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ErrConfigNotFound is returned by providers when no config is stored under the key
+var ErrConfigNotFound = errors.New("remote config not found")
+
+// StatusError is an unexpected HTTP response of a provider
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string { return "Failed to get remote config: " + e.Status }
+
+func (e *StatusError) Unwrap() error {
+	if e.Code == http.StatusNotFound {
+		return ErrConfigNotFound
+	}
+	return nil
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// retryable reports whether a failed fetch should be retried, transport errors and
+// temporary HTTP errors are
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// newProvider selects the provider by name, or by the scheme of the endpoint if name is empty.
+// Endpoints without a scheme and http(s) endpoints use the virzz protocol, plain+http(s)
+// endpoints the plain HTTP provider.
+func newProvider(name string, o *ProviderOptions) (ConfigProvider, error) {
+	providersMu.RLock()
+	if name == "" {
+		name = providerSchemes[o.Endpoint.Scheme]
+	}
+	if name == "" {
+		name = "virzz"
+	}
+	f, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown remote provider %q, expected one of: %s", name, strings.Join(Providers(), ", "))
+	}
+	return f(o)
+}
+
+// fetchRetry fetches key, retrying failures with backoff
+func fetchRetry(ctx context.Context, p ConfigProvider, key string, o *RemoteOptions, logger *slog.Logger) ([]byte, string, error) {
+	for attempt := 0; ; attempt++ {
+		buf, contentType, err := p.Fetch(ctx, key)
+		if err == nil {
+			return buf, contentType, nil
+		}
+		if !retryable(err) || attempt >= o.Retries {
+			return nil, "", err
+		}
+		wait := o.backoff(attempt)
+		logger.Warn("Failed to request remote, retrying", "err", err.Error(), "wait", wait.String())
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// httpGet requests target with the provider headers and returns the body and its Content-Type
+func httpGet(ctx context.Context, o *ProviderOptions, target string, header http.Header) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, value := range o.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return doRequest(o.client(), req)
+}
+
+func doRequest(client *http.Client, req *http.Request) ([]byte, string, error) {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rsp.Body.Close()
+	buf, err := readBody(rsp)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, rsp.Header.Get("Content-Type"), nil
+}
+
+// readBody reads a successful response, other responses are returned as StatusError
+func readBody(rsp *http.Response) ([]byte, error) {
+	if rsp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: rsp.StatusCode, Status: rsp.Status}
+	}
+	return io.ReadAll(rsp.Body)
+}
+
+func (o *ProviderOptions) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
+
+// joinKey appends the key to the path of the endpoint
+func joinKey(prefix, key string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(key, "/")
+}
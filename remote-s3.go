@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterProvider("s3", func(o *ProviderOptions) (ConfigProvider, error) {
+		return &s3Provider{o}, nil
+	}, "s3", "s3+http")
+}
+
+// s3Provider gets <prefix>/<key> from S3 compatible object storage with path style requests,
+// e.g. s3://minio.local:9000/bucket/prefix?region=us-east-1, s3+http:// uses plain http.
+// Credentials are taken from the URL or $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY
+// and $AWS_SESSION_TOKEN, requests are anonymous without them.
+type s3Provider struct{ o *ProviderOptions }
+
+func (p *s3Provider) Fetch(ctx context.Context, key string) ([]byte, string, error) {
+	target := url.URL{Scheme: "https", Host: p.o.Endpoint.Host, Path: joinKey(p.o.Endpoint.Path, key)}
+	if p.o.Endpoint.Scheme == "s3+http" {
+		target.Scheme = "http"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, value := range p.o.Headers {
+		req.Header.Set(name, value)
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if user := p.o.Endpoint.User; user != nil {
+		accessKey = user.Username()
+		secretKey, _ = user.Password()
+	}
+	if accessKey != "" {
+		region := p.o.Endpoint.Query().Get("region")
+		for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+			if region == "" {
+				region = os.Getenv(env)
+			}
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" && p.o.Endpoint.User == nil {
+			req.Header.Set("X-Amz-Security-Token", token)
+		}
+		req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+		signV4(req, accessKey, secretKey, region, "s3", time.Now())
+	}
+	return doRequest(p.o.client(), req)
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 signs a request without body with AWS Signature Version 4,
+// covering the host and all X-Amz-* headers
+func signV4(req *http.Request, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	slices.Sort(params)
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = emptySHA256
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := t.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{t.Format("20060102"), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and slashes unless in a query
+func awsEscape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !query:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
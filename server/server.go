@@ -0,0 +1,223 @@
+// Package server is the reference server of the virzz remote config protocol.
+//
+// Configs are stored by the keys daemons request, by default /<project>/<appID>/<version>/<instance>,
+// see daemon.DefaultRemoteKeys. The server decrypts the session secret of a request with its RSA private key and answers
+// with the config sealed for that request, see daemon.RemoteProtocol.
+package server
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virzz/daemon/v2"
+)
+
+// maxRequestSize bounds the request body, a few wrapped keys and a nonce
+const maxRequestSize = 64 << 10
+
+// Store looks up the config of a key
+type Store interface {
+	// Get returns the config and its Content-Type, daemon.ErrConfigNotFound if there is none
+	Get(key string) ([]byte, string, error)
+}
+
+// Server answers remote config requests from a Store
+type Server struct {
+	Store  Store
+	Keys   []*rsa.PrivateKey
+	Logger *slog.Logger
+	// Prefix is the path the server is mounted under, the path of the remote endpoint of the
+	// daemons. It is trimmed from the request path to get the key.
+	Prefix string
+
+	replay daemon.ReplayCache
+}
+
+// New returns a server for the store, the first key is the current one,
+// older keys are accepted from clients that don't know the current one yet
+func New(store Store, keys ...*rsa.PrivateKey) *Server {
+	return &Server{Store: store, Keys: keys, Logger: slog.Default()}
+}
+
+// CheckKey checks that a key is an absolute slash separated path in canonical form,
+// e.g. /project/appID/version/instance
+func CheckKey(key string) error {
+	if !strings.HasPrefix(key, "/") || path.Clean(key) != key || key == "/" {
+		return errors.New("invalid key " + strconv.Quote(key))
+	}
+	for _, p := range strings.Split(key[1:], "/") {
+		if p == "." || p == ".." || strings.ContainsAny(p, `\`) {
+			return errors.New("invalid key " + strconv.Quote(key))
+		}
+	}
+	return nil
+}
+
+func (s *Server) error(w http.ResponseWriter, r *http.Request, code int, err error) {
+	s.Logger.Warn("Rejected config request", "key", r.URL.Path, "remote", r.RemoteAddr, "err", err.Error())
+	http.Error(w, http.StatusText(code), code)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.error(w, r, http.StatusMethodNotAllowed, errors.New("method "+r.Method))
+		return
+	}
+	// The key sealed with the config is the one the store is asked for
+	key, ok := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(s.Prefix, "/"))
+	if !ok {
+		s.error(w, r, http.StatusNotFound, errors.New("outside of prefix "+s.Prefix))
+		return
+	}
+	if err := CheckKey(key); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if v := r.Header.Get(daemon.RemoteProtocolHeader); v != strconv.Itoa(daemon.RemoteProtocol) {
+		s.error(w, r, http.StatusBadRequest, errors.New("unsupported protocol version "+strconv.Quote(v)))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var req daemon.RemoteRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	if err = req.Check(now); err != nil {
+		s.error(w, r, http.StatusForbidden, err)
+		return
+	}
+	secret, err := req.Unwrap(s.Keys...)
+	if err != nil {
+		s.error(w, r, http.StatusForbidden, err)
+		return
+	}
+	// Only authenticated requests are recorded
+	if err = s.replay.Check(&req, now); err != nil {
+		s.error(w, r, http.StatusForbidden, err)
+		return
+	}
+	data, contentType, err := s.Store.Get(key)
+	if errors.Is(err, daemon.ErrConfigNotFound) {
+		s.error(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.Logger.Error("Failed to load config", "key", key, "err", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	buf, err := req.Seal(secret, key, contentType, data)
+	if err != nil {
+		s.Logger.Error("Failed to seal config", "key", key, "err", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		// The Content-Type is authenticated, keep net/http from sniffing one
+		w.Header()["Content-Type"] = nil
+	}
+	w.Header().Set(daemon.RemoteProtocolHeader, strconv.Itoa(daemon.RemoteProtocol))
+	w.Write(buf)
+	s.Logger.Info("Served config", "key", key, "remote", r.RemoteAddr, "host", r.Header.Get(daemon.RemoteHostnameHeader))
+}
+
+// ParsePrivateKey decodes a PEM encoded PKCS#1 or PKCS#8 RSA private key
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Failed to decode PEM block containing private key")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		return k, nil
+	}
+	return nil, errors.New("not an RSA private key")
+}
+
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+}
+
+// DirStore serves <Dir>/<key>.<ext> with ext one of json, yaml, yml or toml
+type DirStore struct{ Dir string }
+
+func (s DirStore) Get(key string) ([]byte, string, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, "", err
+	}
+	fn := filepath.Join(s.Dir, filepath.FromSlash(key))
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		buf, err := os.ReadFile(fn + ext)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return buf, contentTypes[ext], err
+	}
+	return nil, "", daemon.ErrConfigNotFound
+}
+
+// MemoryStore keeps configs in memory
+type MemoryStore struct {
+	mu      sync.RWMutex
+	configs map[string]memoryConfig
+}
+
+type memoryConfig struct {
+	data        []byte
+	contentType string
+}
+
+// Put stores the config of key
+func (s *MemoryStore) Put(key string, data []byte, contentType string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configs == nil {
+		s.configs = make(map[string]memoryConfig)
+	}
+	s.configs[key] = memoryConfig{data, contentType}
+	return nil
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.configs[key]
+	if !ok {
+		return nil, "", daemon.ErrConfigNotFound
+	}
+	return c.data, c.contentType, nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/virzz/daemon/v2"
+)
+
+const testKey = "/project/com.example.app/1.0.0/default"
+
+func newClient(t *testing.T, url string, pub ...*rsa.PublicKey) *daemon.RemoteProvider {
+	t.Helper()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	keys, err := daemon.WrapKey(secret, pub...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &daemon.RemoteProvider{Keys: keys, Secret: secret, Endpoint: url}
+}
+
+func newServer(t *testing.T, store Store, keys ...*rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	s := New(store, keys...)
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServer(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &MemoryStore{}
+	store.Put(testKey, []byte("a: 1\n"), "application/yaml")
+	srv := newServer(t, store, key)
+
+	c := newClient(t, srv.URL, &key.PublicKey)
+	buf, contentType, err := c.Fetch(context.Background(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "a: 1\n" || contentType != "application/yaml" {
+		t.Errorf("unexpected config %q %s", buf, contentType)
+	}
+	// Through viper's remote provider interface
+	r, err := c.Get(testRemote{srv.URL, testKey, string(c.Secret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ = io.ReadAll(r); string(buf) != "a: 1\n" {
+		t.Errorf("unexpected config %q", buf)
+	}
+
+	_, _, err = c.Fetch(context.Background(), "/project/com.example.app/1.0.0/missing")
+	if !errors.Is(err, daemon.ErrConfigNotFound) {
+		t.Errorf("expected ErrConfigNotFound, got %v", err)
+	}
+	if _, _, err = c.Fetch(context.Background(), "/project/../../etc/passwd"); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+}
+
+func TestServerPrefix(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &MemoryStore{}
+	// A key template with a shape of its own, e.g. /{project}/{hostname}.{env}
+	store.Put("/project/web-1.prod", []byte(`{"a":1}`), "application/json")
+	s := New(store, key)
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.Prefix = "/configs/"
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c := newClient(t, srv.URL+"/configs", &key.PublicKey)
+	if buf, _, err := c.Fetch(context.Background(), "/project/web-1.prod"); err != nil || string(buf) != `{"a":1}` {
+		t.Errorf("expected the config below the prefix, got %q %v", buf, err)
+	}
+	for _, key := range []string{"/project//web-1.prod", "/project/./web-1.prod", "/"} {
+		if err := CheckKey(key); err == nil {
+			t.Errorf("expected %q to be rejected", key)
+		}
+	}
+	c = newClient(t, srv.URL, &key.PublicKey)
+	var se *daemon.StatusError
+	if _, _, err := c.Fetch(context.Background(), "/project/web-1.prod"); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Errorf("expected a key outside of the prefix not to be found, got %v", err)
+	}
+}
+
+func TestServerKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &MemoryStore{}
+	store.Put(testKey, []byte(`{"a":1}`), "application/json")
+	srv := newServer(t, store, newKey, oldKey)
+
+	// Clients built before the rotation only know the old key
+	for _, pub := range [][]*rsa.PublicKey{{&oldKey.PublicKey}, {&newKey.PublicKey}, {&otherKey.PublicKey, &newKey.PublicKey}} {
+		if _, _, err := newClient(t, srv.URL, pub...).Fetch(context.Background(), testKey); err != nil {
+			t.Error(err)
+		}
+	}
+	_, _, err := newClient(t, srv.URL, &otherKey.PublicKey).Fetch(context.Background(), testKey)
+	var se *daemon.StatusError
+	if !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Errorf("expected an unknown key to be forbidden, got %v", err)
+	}
+}
+
+func TestServerReplay(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &MemoryStore{}
+	store.Put(testKey, []byte(`{"a":1}`), "application/json")
+	srv := newServer(t, store, key)
+	keys, _ := daemon.WrapKey(make([]byte, 32), &key.PublicKey)
+
+	post := func(req *daemon.RemoteRequest) int {
+		body, _ := json.Marshal(req)
+		hreq, _ := http.NewRequest(http.MethodPost, srv.URL+testKey, bytes.NewReader(body))
+		hreq.Header.Set(daemon.RemoteProtocolHeader, strconv.Itoa(daemon.RemoteProtocol))
+		rsp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	req, _ := daemon.NewRemoteRequest(keys)
+	if code := post(req); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := post(req); code != http.StatusForbidden {
+		t.Errorf("expected a replayed request to be forbidden, got %d", code)
+	}
+	req, _ = daemon.NewRemoteRequest(keys)
+	req.Timestamp = time.Now().Add(-time.Hour).Unix()
+	if code := post(req); code != http.StatusForbidden {
+		t.Errorf("expected an expired request to be forbidden, got %d", code)
+	}
+	// A request for another key doesn't burn its nonce
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKeys, _ := daemon.WrapKey(make([]byte, 32), &other.PublicKey)
+	req, _ = daemon.NewRemoteRequest(otherKeys)
+	if code := post(req); code != http.StatusForbidden {
+		t.Errorf("expected a request for another key to be forbidden, got %d", code)
+	}
+	req.Keys = keys
+	if code := post(req); code != http.StatusOK {
+		t.Errorf("expected the nonce of an unauthenticated request not to be recorded, got %d", code)
+	}
+
+	replay := daemon.ReplayCache{Max: 2}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		req, _ = daemon.NewRemoteRequest(keys)
+		if err := replay.Check(req, now); (err == nil) != want {
+			t.Errorf("request %d: unexpected result %v", i, err)
+		}
+	}
+	req, _ = daemon.NewRemoteRequest(keys)
+	req.Timestamp = now.Add(time.Hour).Unix()
+	if err := replay.Check(req, now.Add(time.Hour)); err != nil {
+		t.Errorf("expected the expired nonces to make room, got %v", err)
+	}
+	rsp, _ := http.Get(srv.URL + testKey)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %s", rsp.Status)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, filepath.FromSlash(testKey)+".toml")
+	os.MkdirAll(filepath.Dir(fn), 0755)
+	os.WriteFile(fn, []byte("a = 1\n"), 0644)
+	s := DirStore{Dir: dir}
+	buf, contentType, err := s.Get(testKey)
+	if err != nil || string(buf) != "a = 1\n" || contentType != "application/toml" {
+		t.Errorf("unexpected config %q %s %v", buf, contentType, err)
+	}
+	if _, _, err = s.Get("/project/com.example.app/1.0.0/other"); !errors.Is(err, daemon.ErrConfigNotFound) {
+		t.Errorf("expected ErrConfigNotFound, got %v", err)
+	}
+	if _, _, err = s.Get("/../../../etc"); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+}
+
+type testRemote struct{ endpoint, path, secret string }
+
+func (r testRemote) Provider() string      { return "virzz" }
+func (r testRemote) Endpoint() string      { return r.endpoint }
+func (r testRemote) Path() string          { return r.path }
+func (r testRemote) SecretKeyring() string { return r.secret }
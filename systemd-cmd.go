@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 func (s *Systemd) Command(rootCmd *cobra.Command) {
 	var persistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if s.spec.user {
+			return nil
+		}
 		_user, err := user.Current()
 		if err != nil {
 			return err
@@ -22,14 +29,46 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 	}
 
 	var installCmd = &cobra.Command{
-		GroupID:           "daemon",
-		Use:               "install",
-		Short:             "Install",
-		Aliases:           []string{"i"},
-		PersistentPreRunE: persistentPreRunE,
+		GroupID: "daemon",
+		Use:     "install",
+		Short:   "Install",
+		Aliases: []string{"i"},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			diff, _ := cmd.Flags().GetBool("diff")
+			if dryRun || diff {
+				return nil
+			}
+			return persistentPreRunE(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			multi, _ := cmd.Flags().GetBool("multi")
-			return std.systemd.Install(multi, args...)
+			var opts InstallOptions
+			opts.Multi, _ = cmd.Flags().GetBool("multi")
+			opts.DryRun, _ = cmd.Flags().GetBool("dry-run")
+			opts.Diff, _ = cmd.Flags().GetBool("diff")
+			opts.Force, _ = cmd.Flags().GetBool("force")
+			if err := s.applyUnitFlags(cmd); err != nil {
+				return err
+			}
+			t, err := s.target(cmd)
+			if err != nil {
+				return err
+			}
+			phase := HookPostInstall
+			if t.installed() {
+				phase = HookPostUpgrade
+			}
+			// The hook runs once the units are written, its config is loaded and validated
+			// before so that an invalid config fails the install without changing anything
+			if !opts.DryRun && !opts.Diff {
+				if err = t.prepareHooks(cmd, phase); err != nil {
+					return err
+				}
+			}
+			if err = t.Install(opts, args...); err != nil || opts.DryRun || opts.Diff {
+				return err
+			}
+			return t.runHooks(cmd, phase)
 		},
 	}
 
@@ -39,8 +78,22 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		Short:             "Remove(Uninstall)",
 		Aliases:           []string{"rm", "uninstall", "uni", "un"},
 		PersistentPreRunE: persistentPreRunE,
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return std.systemd.Remove()
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			t, err := s.target(cmd)
+			if err != nil {
+				return err
+			}
+			// The config of the hooks is loaded before the units are touched
+			if err = t.prepareHooks(cmd, HookPreRemove, HookPostRemove); err != nil {
+				return err
+			}
+			if err = t.runHooks(cmd, HookPreRemove); err != nil {
+				return err
+			}
+			if err = t.Remove(); err != nil {
+				return err
+			}
+			return t.runHooks(cmd, HookPostRemove)
 		},
 	}
 	var startCmd = &cobra.Command{
@@ -51,7 +104,7 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			num, _ := cmd.Flags().GetInt("num")
-			return std.systemd.Start(num, args...)
+			return s.each(cmd, func(t *Systemd) error { return t.Start(num, args...) })
 		},
 	}
 
@@ -62,7 +115,7 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			all, _ := cmd.Flags().GetBool("all")
-			return std.systemd.Stop(all, args...)
+			return s.each(cmd, func(t *Systemd) error { return t.Stop(all, args...) })
 		},
 	}
 
@@ -74,7 +127,7 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			all, _ := cmd.Flags().GetBool("all")
-			return std.systemd.Restart(all, args...)
+			return s.each(cmd, func(t *Systemd) error { return t.Restart(all, args...) })
 		},
 	}
 
@@ -86,7 +139,7 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			all, _ := cmd.Flags().GetBool("all")
-			return std.systemd.Kill(all, args...)
+			return s.each(cmd, func(t *Systemd) error { return t.Kill(all, args...) })
 		},
 	}
 
@@ -97,7 +150,7 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			all, _ := cmd.Flags().GetBool("all")
-			return std.systemd.Reload(all, args...)
+			return s.each(cmd, func(t *Systemd) error { return t.Reload(all, args...) })
 		},
 	}
 
@@ -107,9 +160,11 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		Short:             "Status",
 		Aliases:           []string{"info", "if"},
 		PersistentPreRunE: persistentPreRunE,
-		RunE: func(_ *cobra.Command, _ []string) error {
-			_, err := std.systemd.Status(true)
-			return err
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return s.each(cmd, func(t *Systemd) error {
+				_, err := t.Status(true)
+				return err
+			})
 		},
 	}
 
@@ -120,20 +175,33 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		Short:             "print systemd unit service file",
 		PersistentPreRunE: persistentPreRunE,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if t, _ := cmd.Flags().GetBool("template"); t {
+			template, _ := cmd.Flags().GetBool("template")
+			if template {
+				if err := s.applyUnitFlags(cmd); err != nil {
+					return err
+				}
+			}
+			t, err := s.target(cmd)
+			if err != nil {
+				return err
+			}
+			if template {
 				execPath, err := os.Executable()
 				if err != nil {
 					return err
 				}
 				multi, _ := cmd.Flags().GetBool("multi")
-				buf, err := CreateUnit(multi, s.Name, s.Description, execPath, args...)
+				buf, err := t.spec.createUnit(multi, t.Name, t.Description, execPath, append(slices.Clone(t.args), args...)...)
 				if err != nil {
 					return err
 				}
 				fmt.Println(string(buf))
 				return nil
 			}
-			fn := "/etc/systemd/system/" + s.Name + "@.service"
+			fn, err := t.unitPath()
+			if err != nil {
+				return err
+			}
 			s.logger.Info("filepath = " + fn)
 			buf, err := os.ReadFile(fn)
 			if err != nil {
@@ -144,13 +212,105 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 		},
 	}
 
+	var securityCmd = &cobra.Command{
+		GroupID: "daemon",
+		Use:     "security",
+		Short:   "Score the sandboxing of the installed unit",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			t, err := s.target(cmd)
+			if err != nil {
+				return err
+			}
+			report, err := t.Security()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, c := range report.Checks {
+				mark := "✓"
+				if c.Exposure >= 1 {
+					mark = "✗"
+				} else if c.Exposure > 0 {
+					mark = "~"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", mark, c.Name, c.Description)
+			}
+			w.Flush()
+			fmt.Printf("\nOverall exposure level for %s: %.1f %s\n", t.Name, report.Exposure, report.Rating())
+			return nil
+		},
+	}
+
+	var limitsCmd = &cobra.Command{
+		GroupID: "daemon",
+		Use:     "limits",
+		Short:   "Manage resource limits of instances",
+	}
+	var limitsSetCmd = &cobra.Command{
+		Use:               "set <instance>",
+		Short:             "Apply resource limits to a running instance and persist them",
+		Args:              cobra.ExactArgs(1),
+		PersistentPreRunE: persistentPreRunE,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l, err := limitsFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			if l == (Limits{}) {
+				return errors.New("no limits given")
+			}
+			t, err := s.target(cmd)
+			if err != nil {
+				return err
+			}
+			return t.SetLimits(args[0], l)
+		},
+	}
+	limitsCmd.AddCommand(limitsSetCmd)
+	addLimitFlags(limitsSetCmd.Flags())
+
+	var timersCmd = &cobra.Command{
+		GroupID: "daemon",
+		Use:     "timers",
+		Short:   "Scheduled tasks",
+	}
+	timersCmd.AddCommand(&cobra.Command{
+		Use:     "list",
+		Short:   "Show next and last trigger times of the task timers",
+		Aliases: []string{"ls"},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			items, err := s.Timers()
+			if err != nil {
+				return err
+			}
+			format := func(t time.Time) string {
+				if t.IsZero() {
+					return "n/a"
+				}
+				return t.Format(time.DateTime)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TIMER\tSTATE\tNEXT\tLAST")
+			for _, item := range items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Name, item.ActiveState, format(item.Next), format(item.Last))
+			}
+			return w.Flush()
+		},
+	})
+
 	// Daemon commands
 	rootCmd.AddGroup(&cobra.Group{ID: "daemon", Title: "Systemd commands"})
 	rootCmd.AddCommand(
 		installCmd, removeCmd, reloadCmd, unitCmd,
-		startCmd, stopCmd, killCmd, restartCmd, statusCmd,
+		startCmd, stopCmd, killCmd, restartCmd, statusCmd, securityCmd, limitsCmd, timersCmd,
 	)
 	installCmd.Flags().BoolP("multi", "m", false, "Use template unit service")
+	installCmd.Flags().Bool("dry-run", false, "Print the unit file instead of installing it")
+	installCmd.Flags().Bool("diff", false, "Show a unified diff against the installed unit file")
+	installCmd.Flags().BoolP("force", "f", false, "Overwrite a locally modified unit file")
+	installCmd.Flags().Bool("no-hooks", false, "Don't run the post-install and post-upgrade hooks")
+	removeCmd.Flags().Bool("no-hooks", false, "Don't run the pre-remove and post-remove hooks")
+	installCmd.Flags().String("hardening", s.spec.hardening, "Sandboxing preset: "+strings.Join(HardeningPresets(), ", "))
 	startCmd.Flags().IntP("num", "n", 0, "Num of Instances for start")
 	stopCmd.Flags().BoolP("all", "a", false, "Stop all Instances")
 	restartCmd.Flags().BoolP("all", "a", false, "Restart all Instances")
@@ -158,4 +318,45 @@ func (s *Systemd) Command(rootCmd *cobra.Command) {
 	reloadCmd.Flags().BoolP("all", "a", false, "Reload all Instances")
 	unitCmd.Flags().BoolP("template", "t", false, "Show template unit service file")
 	unitCmd.Flags().BoolP("multi", "m", false, "Use template unit service")
+	addLimitFlags(installCmd.Flags())
+	addLimitFlags(unitCmd.Flags())
+	unitCmd.Flags().String("hardening", s.spec.hardening, "Sandboxing preset: "+strings.Join(HardeningPresets(), ", "))
+}
+
+// each runs fn for the component selected by --component, or for every service
+func (s *Systemd) each(cmd *cobra.Command, fn func(t *Systemd) error) error {
+	targets, err := s.targets(cmd)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0, len(targets))
+	for _, t := range targets {
+		errs = append(errs, fn(t))
+	}
+	return errors.Join(errs...)
+}
+
+// applyUnitFlags applies the unit related flags of install and unit to the unit config
+func (s *Systemd) applyUnitFlags(cmd *cobra.Command) error {
+	if cmd.Flags().Changed("env") {
+		env, err := profile(cmd, s.spec.envVar)
+		if err != nil {
+			return err
+		}
+		s.spec.env = env
+	}
+	if cmd.Flags().Changed("hardening") {
+		preset, _ := cmd.Flags().GetString("hardening")
+		if err := s.spec.setHardening(preset); err != nil {
+			return err
+		}
+	}
+	l, err := limitsFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	if err = s.spec.setLimits(s.spec.limits.merge(l)); err != nil {
+		return err
+	}
+	return s.spec.check()
 }
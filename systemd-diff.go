@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	a, b int // line index in a and b when the op is applied
+}
+
+func splitLines(buf []byte) []string {
+	s := string(buf)
+	if s == "" {
+		return nil
+	}
+	return strings.SplitAfter(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes an edit script from x to y based on the longest common subsequence
+func diffLines(x, y []string) []diffOp {
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if strings.TrimSuffix(x[i], "\n") == strings.TrimSuffix(y[j], "\n") {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	ops := make([]diffOp, 0, len(x)+len(y))
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case strings.TrimSuffix(x[i], "\n") == strings.TrimSuffix(y[j], "\n"):
+			ops = append(ops, diffOp{' ', y[j], i, j})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', x[i], i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', y[j], i, j})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		ops = append(ops, diffOp{'-', x[i], i, j})
+	}
+	for ; j < len(y); j++ {
+		ops = append(ops, diffOp{'+', y[j], i, j})
+	}
+	return ops
+}
+
+// unifiedDiff returns the unified diff between a and b, empty if they are equal
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+	var out strings.Builder
+	for k := 0; k < len(ops); {
+		for k < len(ops) && ops[k].kind == ' ' {
+			k++
+		}
+		if k == len(ops) {
+			break
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		start, end := max(k-diffContext, 0), k
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = run
+		}
+		hunk := ops[start:end]
+		lenA, lenB := 0, 0
+		for _, op := range hunk {
+			if op.kind != '+' {
+				lenA++
+			}
+			if op.kind != '-' {
+				lenB++
+			}
+		}
+		startA, startB := hunk[0].a, hunk[0].b
+		if lenA > 0 {
+			startA++
+		}
+		if lenB > 0 {
+			startB++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", startA, lenA, startB, lenB)
+		for _, op := range hunk {
+			out.WriteByte(op.kind)
+			out.WriteString(strings.TrimSuffix(op.line, "\n"))
+			out.WriteByte('\n')
+		}
+		k = end
+	}
+	return out.String()
+}
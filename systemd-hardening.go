@@ -0,0 +1,235 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+)
+
+// Hardening presets for the generated unit
+const (
+	HardeningNone           = ""
+	HardeningBasic          = "basic"
+	HardeningStrict         = "strict"
+	HardeningNetworkService = "network-service"
+)
+
+var sandboxOptions = map[string]string{
+	"DynamicUser":             "yes",
+	"ProtectSystem":           "strict",
+	"ProtectHome":             "yes",
+	"PrivateTmp":              "yes",
+	"PrivateDevices":          "yes",
+	"NoNewPrivileges":         "yes",
+	"ProtectKernelTunables":   "yes",
+	"ProtectKernelModules":    "yes",
+	"ProtectKernelLogs":       "yes",
+	"ProtectControlGroups":    "yes",
+	"ProtectClock":            "yes",
+	"ProtectHostname":         "yes",
+	"RestrictNamespaces":      "yes",
+	"RestrictRealtime":        "yes",
+	"RestrictSUIDSGID":        "yes",
+	"LockPersonality":         "yes",
+	"MemoryDenyWriteExecute":  "yes",
+	"SystemCallArchitectures": "native",
+	"SystemCallFilter":        "@system-service",
+	"UMask":                   "0077",
+}
+
+func withOptions(base map[string]string, opts map[string]string) map[string]string {
+	m := maps.Clone(base)
+	maps.Copy(m, opts)
+	return m
+}
+
+var hardeningPresets = map[string]map[string]string{
+	HardeningBasic: {
+		"NoNewPrivileges": "yes",
+		"PrivateTmp":      "yes",
+		"ProtectSystem":   "full",
+		"ProtectHome":     "read-only",
+	},
+	HardeningStrict: withOptions(sandboxOptions, map[string]string{
+		"CapabilityBoundingSet":   "",
+		"RestrictAddressFamilies": "AF_UNIX",
+	}),
+	HardeningNetworkService: withOptions(sandboxOptions, map[string]string{
+		"CapabilityBoundingSet":   "CAP_NET_BIND_SERVICE",
+		"AmbientCapabilities":     "CAP_NET_BIND_SERVICE",
+		"RestrictAddressFamilies": "AF_UNIX AF_INET AF_INET6 AF_NETLINK",
+	}),
+}
+
+// HardeningPresets returns the names of the available hardening presets
+func HardeningPresets() []string {
+	names := make([]string, 0, len(hardeningPresets))
+	for name := range hardeningPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetHardening selects the sandboxing preset applied to the generated unit of the default daemon.
+// Options set with SetUnitConfig take precedence over the preset.
+func SetHardening(preset string) error { return Default().SetHardening(preset) }
+
+func (d *Daemon) SetHardening(preset string) error { return d.systemd.spec.setHardening(preset) }
+
+func (spec *unitSpec) setHardening(preset string) error {
+	if _, ok := hardeningPresets[preset]; !ok && preset != HardeningNone {
+		return fmt.Errorf("unknown hardening preset %q, available: %s", preset, strings.Join(HardeningPresets(), ", "))
+	}
+	spec.hardening = preset
+	return nil
+}
+
+// SecurityCheck is a single item of a SecurityReport
+type SecurityCheck struct {
+	Name        string
+	Description string
+	Weight      float64
+	Exposure    float64 // 0 is fully protected, 1 is fully exposed
+}
+
+// SecurityReport scores the sandboxing of a unit, similar to systemd-analyze security
+type SecurityReport struct {
+	Checks   []SecurityCheck
+	Exposure float64 // 0.0 (safe) to 10.0 (unsafe)
+}
+
+func (r *SecurityReport) Rating() string {
+	switch {
+	case r.Exposure < 2:
+		return "OK"
+	case r.Exposure < 5:
+		return "MEDIUM"
+	case r.Exposure < 8:
+		return "EXPOSED"
+	}
+	return "UNSAFE"
+}
+
+type securityRule struct {
+	name, desc string
+	weight     float64
+	exposure   func(opts map[string]string) float64
+}
+
+func enabled(name string) func(map[string]string) float64 {
+	return func(opts map[string]string) float64 {
+		if isTrue(opts[name]) {
+			return 0
+		}
+		return 1
+	}
+}
+
+func configured(name string) func(map[string]string) float64 {
+	return func(opts map[string]string) float64 {
+		if v, ok := opts[name]; ok && v != "~" {
+			return 0
+		}
+		return 1
+	}
+}
+
+var securityRules = []securityRule{
+	{"User", "Service runs as an unprivileged user", 10, func(opts map[string]string) float64 {
+		if isTrue(opts["DynamicUser"]) {
+			return 0
+		}
+		if u := opts["User"]; u != "" && u != "root" && u != "0" {
+			return 0
+		}
+		return 1
+	}},
+	{"NoNewPrivileges", "Service processes cannot acquire new privileges", 5, enabled("NoNewPrivileges")},
+	{"ProtectSystem", "Service has read-only access to the OS file hierarchy", 5, func(opts map[string]string) float64 {
+		switch opts["ProtectSystem"] {
+		case "strict":
+			return 0
+		case "full":
+			return 0.3
+		}
+		if isTrue(opts["ProtectSystem"]) {
+			return 0.6
+		}
+		return 1
+	}},
+	{"ProtectHome", "Service has no access to home directories", 5, func(opts map[string]string) float64 {
+		switch opts["ProtectHome"] {
+		case "read-only":
+			return 0.4
+		case "tmpfs":
+			return 0.1
+		}
+		return enabled("ProtectHome")(opts)
+	}},
+	{"CapabilityBoundingSet", "Service capabilities are restricted", 8, func(opts map[string]string) float64 {
+		v, ok := opts["CapabilityBoundingSet"]
+		if !ok || strings.Contains(v, "CAP_SYS_ADMIN") {
+			return 1
+		}
+		return 0
+	}},
+	{"SystemCallFilter", "System calls are filtered", 6, configured("SystemCallFilter")},
+	{"RestrictAddressFamilies", "Socket address families are restricted", 4, configured("RestrictAddressFamilies")},
+	{"PrivateTmp", "Service has a private /tmp", 3, enabled("PrivateTmp")},
+	{"PrivateDevices", "Service has no access to hardware devices", 3, enabled("PrivateDevices")},
+	{"ProtectKernelTunables", "Service cannot alter kernel tunables", 3, enabled("ProtectKernelTunables")},
+	{"ProtectKernelModules", "Service cannot load kernel modules", 3, enabled("ProtectKernelModules")},
+	{"ProtectControlGroups", "Service cannot modify the control group file system", 3, enabled("ProtectControlGroups")},
+	{"RestrictNamespaces", "Service cannot create namespaces", 3, enabled("RestrictNamespaces")},
+	{"ProtectKernelLogs", "Service cannot read the kernel log ring buffer", 2, enabled("ProtectKernelLogs")},
+	{"RestrictSUIDSGID", "Service cannot create SUID/SGID files", 2, enabled("RestrictSUIDSGID")},
+	{"MemoryDenyWriteExecute", "Service cannot create writable executable memory", 2, enabled("MemoryDenyWriteExecute")},
+	{"SystemCallArchitectures", "Service may only call native system calls", 2, func(opts map[string]string) float64 {
+		if opts["SystemCallArchitectures"] == "native" {
+			return 0
+		}
+		return 1
+	}},
+	{"RestrictRealtime", "Service cannot acquire realtime scheduling", 1, enabled("RestrictRealtime")},
+	{"LockPersonality", "Service cannot change the execution domain", 1, enabled("LockPersonality")},
+	{"ProtectClock", "Service cannot change the system clock", 1, enabled("ProtectClock")},
+	{"ProtectHostname", "Service cannot change the hostname", 1, enabled("ProtectHostname")},
+	{"UMask", "Files created by the service are private", 1, func(opts map[string]string) float64 {
+		switch opts["UMask"] {
+		case "0077", "077":
+			return 0
+		case "0027", "027":
+			return 0.5
+		}
+		return 1
+	}},
+}
+
+// ScoreUnit rates the sandboxing settings of the [Service] section of a unit file
+func ScoreUnit(buf []byte) (*SecurityReport, error) {
+	items, err := unit.DeserializeOptions(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	opts := make(map[string]string)
+	for _, item := range items {
+		if item.Section == "Service" {
+			opts[item.Name] = item.Value
+		}
+	}
+	report := &SecurityReport{Checks: make([]SecurityCheck, 0, len(securityRules))}
+	var total, exposed float64
+	for _, rule := range securityRules {
+		e := rule.exposure(opts)
+		report.Checks = append(report.Checks, SecurityCheck{Name: rule.name, Description: rule.desc, Weight: rule.weight, Exposure: e})
+		total += rule.weight
+		exposed += rule.weight * e
+	}
+	report.Exposure = exposed / total * 10
+	return report, nil
+}
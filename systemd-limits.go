@@ -0,0 +1,211 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Limits are the resource controls of the service, zero values are left unset
+type Limits struct {
+	MemoryMax   uint64 // Bytes
+	MemoryHigh  uint64 // Bytes
+	CPUQuota    uint64 // Percent of one CPU, 200 allows two full CPUs
+	TasksMax    uint64
+	IOWeight    uint64 // 1-10000
+	LimitNOFILE uint64
+}
+
+// SetLimits sets the resource controls written to the generated unit of the default daemon
+func SetLimits(l Limits) error { return Default().SetLimits(l) }
+
+func (d *Daemon) SetLimits(l Limits) error { return d.systemd.spec.setLimits(l) }
+
+func (spec *unitSpec) setLimits(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	spec.limits = l
+	return nil
+}
+
+func (l Limits) Validate() error {
+	if l.IOWeight > 10000 {
+		return errors.Errorf("IOWeight %d out of range 1-10000", l.IOWeight)
+	}
+	if l.MemoryMax != 0 && l.MemoryHigh > l.MemoryMax {
+		return errors.New("MemoryHigh must not exceed MemoryMax")
+	}
+	return nil
+}
+
+// merge returns l with the non zero values of o applied
+func (l Limits) merge(o Limits) Limits {
+	pick := func(a, b uint64) uint64 {
+		if b != 0 {
+			return b
+		}
+		return a
+	}
+	return Limits{
+		MemoryMax:   pick(l.MemoryMax, o.MemoryMax),
+		MemoryHigh:  pick(l.MemoryHigh, o.MemoryHigh),
+		CPUQuota:    pick(l.CPUQuota, o.CPUQuota),
+		TasksMax:    pick(l.TasksMax, o.TasksMax),
+		IOWeight:    pick(l.IOWeight, o.IOWeight),
+		LimitNOFILE: pick(l.LimitNOFILE, o.LimitNOFILE),
+	}
+}
+
+// options returns the [Service] settings of the limits
+func (l Limits) options() map[string]string {
+	opts := make(map[string]string)
+	set := func(name string, v uint64, format func(uint64) string) {
+		if v != 0 {
+			opts[name] = format(v)
+		}
+	}
+	set("MemoryMax", l.MemoryMax, formatSize)
+	set("MemoryHigh", l.MemoryHigh, formatSize)
+	set("CPUQuota", l.CPUQuota, func(v uint64) string { return strconv.FormatUint(v, 10) + "%" })
+	set("TasksMax", l.TasksMax, formatUint)
+	set("IOWeight", l.IOWeight, formatUint)
+	set("LimitNOFILE", l.LimitNOFILE, formatUint)
+	return opts
+}
+
+// properties returns the limits that systemd can change on a running unit
+func (l Limits) properties() []systemd.Property {
+	props := make([]systemd.Property, 0, 5)
+	set := func(name string, v uint64) {
+		if v != 0 {
+			props = append(props, systemd.Property{Name: name, Value: dbus.MakeVariant(v)})
+		}
+	}
+	set("MemoryMax", l.MemoryMax)
+	set("MemoryHigh", l.MemoryHigh)
+	set("CPUQuotaPerSecUSec", l.CPUQuota*10000)
+	set("TasksMax", l.TasksMax)
+	set("IOWeight", l.IOWeight)
+	return props
+}
+
+func formatUint(v uint64) string { return strconv.FormatUint(v, 10) }
+
+func formatSize(v uint64) string {
+	for i := len(sizeSuffixes); i > 0; i-- {
+		shift := 10 * i
+		if v >= 1<<shift && v%(1<<shift) == 0 {
+			return strconv.FormatUint(v>>shift, 10) + sizeSuffixes[i-1:i]
+		}
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func addLimitFlags(fs *pflag.FlagSet) {
+	fs.String("memory-max", "", "Hard memory limit, e.g. 512M")
+	fs.String("memory-high", "", "Memory throttling limit, e.g. 384M")
+	fs.String("cpu-quota", "", "CPU time quota in percent of one CPU, e.g. 150%")
+	fs.Uint64("tasks-max", 0, "Maximum number of tasks")
+	fs.Uint64("io-weight", 0, "IO weight (1-10000)")
+	fs.Uint64("limit-nofile", 0, "Maximum number of open files")
+}
+
+func limitsFromFlags(fs *pflag.FlagSet) (l Limits, err error) {
+	if v, _ := fs.GetString("memory-max"); v != "" {
+		if l.MemoryMax, err = parseSize(v); err != nil {
+			return l, errors.Wrap(err, "memory-max")
+		}
+	}
+	if v, _ := fs.GetString("memory-high"); v != "" {
+		if l.MemoryHigh, err = parseSize(v); err != nil {
+			return l, errors.Wrap(err, "memory-high")
+		}
+	}
+	if v, _ := fs.GetString("cpu-quota"); v != "" {
+		if l.CPUQuota, err = strconv.ParseUint(strings.TrimSuffix(v, "%"), 10, 64); err != nil {
+			return l, errors.Wrap(err, "cpu-quota")
+		}
+	}
+	l.TasksMax, _ = fs.GetUint64("tasks-max")
+	l.IOWeight, _ = fs.GetUint64("io-weight")
+	l.LimitNOFILE, _ = fs.GetUint64("limit-nofile")
+	return l, l.Validate()
+}
+
+func (s *Systemd) dropInPath(instance, name string) (string, error) {
+	dir, err := s.unitDir()
+	return dir + s.Name + "@" + instance + ".service.d/" + name, err
+}
+
+// SetLimits applies the limits to a running instance and persists them as a drop-in
+func (s *Systemd) SetLimits(instance string, l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	fn, err := s.dropInPath(instance, "50-limits.conf")
+	if err != nil {
+		return err
+	}
+	sections := unitSections{"Service": {}}
+	if buf, err := os.ReadFile(fn); err == nil {
+		opts, err := unit.DeserializeOptions(bytes.NewReader(buf))
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		for _, opt := range opts {
+			if opt.Section == "Service" {
+				sections["Service"][opt.Name] = opt.Value
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for k, v := range l.options() {
+		sections["Service"][k] = v
+	}
+	buf, err := serializeUnit(sections)
+	if err != nil {
+		return err
+	}
+	if err = s.checkUnit(fn, buf); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(fn, buf, 0644); err != nil {
+		return errors.Wrap(err, "write drop-in")
+	}
+	s.logger.Info("Saved limits to " + fn)
+
+	ctx := context.Background()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err = conn.ReloadContext(ctx); err != nil {
+		return err
+	}
+	name := s.Name + "@" + instance + ".service"
+	if props := l.properties(); len(props) > 0 {
+		if err = conn.SetUnitPropertiesContext(ctx, name, true, props...); err != nil {
+			return err
+		}
+		s.logger.Info(fmt.Sprintf("Applied %d limits to [ %s ]", len(props), name))
+	}
+	if l.LimitNOFILE != 0 {
+		s.logger.Warn("LimitNOFILE takes effect after restarting [ " + name + " ]")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Schedule describes when a task runs, see systemd.timer(5)
+type Schedule struct {
+	OnCalendar         string // e.g. "daily" or "*-*-* 03:00:00"
+	OnBootSec          string // e.g. "15min"
+	RandomizedDelaySec string
+	Persistent         bool // Catch up on runs missed while the system was down
+}
+
+type task struct {
+	cmd      *cobra.Command
+	schedule Schedule
+}
+
+// AddTask registers cmd as a subcommand of the default daemon which is run periodically by a
+// <name>-<task>.timer unit installed along with the service
+func AddTask(cmd *cobra.Command, schedule Schedule) error { return Default().AddTask(cmd, schedule) }
+
+func (d *Daemon) AddTask(cmd *cobra.Command, schedule Schedule) error {
+	spec := d.systemd.spec
+	if schedule.OnCalendar == "" && schedule.OnBootSec == "" {
+		return fmt.Errorf("task %s: OnCalendar or OnBootSec is required", cmd.Name())
+	}
+	for _, t := range spec.tasks {
+		if t.cmd.Name() == cmd.Name() {
+			return fmt.Errorf("task %s already registered", cmd.Name())
+		}
+	}
+	preRunE := cmd.PreRunE
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := d.loadConfig(cmd); err != nil {
+			return err
+		}
+		if preRunE != nil {
+			return preRunE(cmd, args)
+		}
+		return nil
+	}
+	spec.tasks = append(spec.tasks, &task{cmd: cmd, schedule: schedule})
+	d.root.AddCommand(cmd)
+	return nil
+}
+
+// CreateTaskUnits returns the oneshot service and the timer unit of a task of the default daemon
+func CreateTaskUnits(binName, desc, path string, t *task) (service, timer []byte, err error) {
+	return Default().systemd.spec.createTaskUnits(binName, desc, path, t)
+}
+
+func (spec *unitSpec) createTaskUnits(binName, desc, path string, t *task) (service, timer []byte, err error) {
+	name := binName + "-" + t.cmd.Name()
+	sections := unitSections{
+		"Unit": {
+			"Description": strings.ToUpper(binName[:1]) + binName[1:] + " " + desc + " " + t.cmd.Name() + " task",
+			"Wants":       "network.target",
+		},
+		"Service": {
+			"Type":             "oneshot",
+			"WorkingDirectory": filepath.Dir(path),
+			"ExecStart":        path + " " + t.cmd.Name(),
+		},
+	}
+	sections.applyPolicy(name, spec)
+	if service, err = serializeUnit(sections, spec.unitOptions()...); err != nil {
+		return nil, nil, err
+	}
+	timerSections := unitSections{
+		"Unit":    {"Description": "Schedule of " + sections["Unit"]["Description"]},
+		"Timer":   {},
+		"Install": {"WantedBy": "timers.target"},
+	}
+	set := func(name, value string) {
+		if value != "" {
+			timerSections["Timer"][name] = value
+		}
+	}
+	set("OnCalendar", t.schedule.OnCalendar)
+	set("OnBootSec", t.schedule.OnBootSec)
+	set("RandomizedDelaySec", t.schedule.RandomizedDelaySec)
+	if t.schedule.Persistent {
+		set("Persistent", "yes")
+	}
+	if timer, err = serializeUnit(timerSections); err != nil {
+		return nil, nil, err
+	}
+	return service, timer, nil
+}
+
+func (s *Systemd) taskUnitName(t *task) string {
+	return s.Name + "-" + t.cmd.Name()
+}
+
+// removeTasks stops and disables the task timers and removes their units
+func (s *Systemd) removeTasks() error {
+	tasks := s.spec.tasks
+	if len(tasks) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	timers := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		timers = append(timers, s.taskUnitName(t)+".timer")
+	}
+	recv := make(chan string, 1)
+	for _, name := range timers {
+		if _, err = conn.StopUnitContext(ctx, name, "replace", recv); err != nil {
+			s.logger.Warn(err.Error())
+			continue
+		}
+		s.logger.Info("Stop [ " + name + " ] " + <-recv)
+	}
+	if _, err = conn.DisableUnitFilesContext(ctx, timers, false); err != nil {
+		s.logger.Warn(err.Error())
+	}
+	dir, err := s.unitDir()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range tasks {
+		for _, ext := range []string{".timer", ".service"} {
+			err := os.Remove(dir + s.taskUnitName(t) + ext)
+			if err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TimerStatus is the trigger state of a task timer
+type TimerStatus struct {
+	Name        string
+	ActiveState string
+	Next        time.Time // Zero if not scheduled
+	Last        time.Time // Zero if never triggered
+}
+
+// Timers returns the trigger times of the task timers
+func (s *Systemd) Timers() ([]TimerStatus, error) {
+	ctx := context.Background()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usec := func(v any) time.Time {
+		if n, ok := v.(uint64); ok && n != 0 {
+			return time.UnixMicro(int64(n))
+		}
+		return time.Time{}
+	}
+	items := make([]TimerStatus, 0, len(s.spec.tasks))
+	for _, t := range s.spec.tasks {
+		name := s.taskUnitName(t) + ".timer"
+		props, err := conn.GetUnitTypePropertiesContext(ctx, name, "Timer")
+		if err != nil {
+			return nil, err
+		}
+		state, err := conn.GetUnitPropertyContext(ctx, name, "ActiveState")
+		if err != nil {
+			return nil, err
+		}
+		active, _ := state.Value.Value().(string)
+		items = append(items, TimerStatus{
+			Name:        name,
+			ActiveState: active,
+			Next:        usec(props["NextElapseUSecRealtime"]),
+			Last:        usec(props["LastTriggerUSec"]),
+		})
+	}
+	return items, nil
+}
@@ -1,85 +1,260 @@
 package daemon
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/coreos/go-systemd/v22/unit"
 )
 
-func SetUnitConfig(section, name, value string) {
-	if _, ok := unitConfig[section]; !ok {
-		unitConfig[section] = make(map[string]string)
+// SetUnitConfig sets an option of the generated unit of the default daemon
+func SetUnitConfig(section, name, value string) { Default().SetUnitConfig(section, name, value) }
+
+func (d *Daemon) SetUnitConfig(section, name, value string) {
+	d.systemd.spec.config.set(section, name, value)
+}
+
+// AllowUnitKeys lets the unit of the default daemon have options the validator doesn't know
+func AllowUnitKeys(section string, names ...string) { Default().AllowUnitKeys(section, names...) }
+
+// AllowUnitKeys lets the unit have options the validator doesn't know, e.g. ones added by a newer
+// systemd. Without names every key of the section is allowed.
+func (d *Daemon) AllowUnitKeys(section string, names ...string) {
+	spec := d.systemd.spec
+	if spec.allowed == nil {
+		spec.allowed = make(unitSections)
+	}
+	if _, ok := spec.allowed[section]; !ok {
+		spec.allowed[section] = make(map[string]string)
+	}
+	for _, name := range names {
+		spec.allowed.set(section, name, "")
+	}
+}
+
+// defaultUnitConfig returns the options every generated service starts from
+func defaultUnitConfig() unitSections {
+	return unitSections{
+		"Unit": {
+			"Wants": "network.target",
+		},
+		"Install": {
+			"DefaultInstance": "default",
+			"WantedBy":        "multi-user.target",
+		},
+		"Service": {
+			"Type":                     "exec",
+			"ExecReload":               "/bin/kill -s HUP $MAINPID", // 发送HUP信号重载服务
+			"Restart":                  "always",                    // 只要不是通过systemctl stop来停止服务，任何情况下都必须要重启服务
+			"RestartSec":               "0",                         // 重启间隔
+			"StartLimitInterval":       "30",                        // 启动尝试间隔
+			"StartLimitBurst":          "10",                        // 最大启动尝试次数
+			"RestartPreventExitStatus": "SIGKILL",                   // kill -9 不重启
+		},
 	}
-	unitConfig[section][name] = value
 }
 
-var unitConfig = map[string]map[string]string{
-	"Unit": {
-		"Wants": "network.target",
-	},
-	"Install": {
-		"DefaultInstance": "default",
-		"WantedBy":        "multi-user.target",
-	},
-	"Service": {
-		"Type":                     "exec",
-		"ExecReload":               "/bin/kill -s HUP $MAINPID", // 发送HUP信号重载服务
-		"Restart":                  "always",                    // 只要不是通过systemctl stop来停止服务，任何情况下都必须要重启服务
-		"RestartSec":               "0",                         // 重启间隔
-		"StartLimitInterval":       "30",                        // 启动尝试间隔
-		"StartLimitBurst":          "10",                        // 最大启动尝试次数
-		"RestartPreventExitStatus": "SIGKILL",                   // kill -9 不重启
-	},
+// unitSpec is everything the units of a daemon are generated from
+type unitSpec struct {
+	config      unitSections
+	hardening   string
+	limits      Limits
+	credentials []Credential
+	// env is the profile installed units run with, set by install --env,
+	// and envVar the variable it is passed in
+	env    string
+	envVar string
+	tasks  []*task
+	// user units are run by the service manager of the user
+	user bool
+	// network is set when the service needs IP sockets of its own, e.g. for the remote config
+	network bool
+	// allowed are the options the validator accepts without knowing them
+	allowed unitSections
 }
 
-func CreateUnit(multi bool, binName, desc, path string, args ...string) ([]byte, error) {
-	if multi {
-		binName += "@%i"
+func newUnitSpec() *unitSpec {
+	return &unitSpec{config: defaultUnitConfig(), hardening: HardeningNone}
+}
+
+// check rejects unit options the service manager of the units can't apply,
+// it runs again once install and unit applied their flags
+func (s *unitSpec) check() error {
+	if !s.user {
+		return nil
 	}
-	if unitConfig == nil {
-		return nil, fmt.Errorf("unitConfig is nil")
+	if isTrue(hardeningPresets[s.hardening]["DynamicUser"]) {
+		return fmt.Errorf("hardening preset %s needs DynamicUser=, which the user service manager doesn't support", s.hardening)
 	}
-	if _, ok := unitConfig["Unit"]; !ok {
-		unitConfig["Unit"] = make(map[string]string)
+	for _, name := range []string{"User", "Group", "DynamicUser"} {
+		if _, ok := s.config["Service"][name]; ok {
+			return fmt.Errorf("unit option %s= can't be used in user mode", name)
+		}
 	}
-	if _, ok := unitConfig["Unit"]["Description"]; !ok {
-		unitConfig["Unit"]["Description"] = strings.ToUpper(binName[:1]) + binName[1:] + " " + desc
+	return nil
+}
+
+// sectionOrder is the order sections are written in, others follow alphabetically
+var sectionOrder = []string{"Unit", "Service", "Timer", "Install"}
+
+type unitSections map[string]map[string]string
+
+func (u unitSections) clone() unitSections {
+	sections := make(unitSections, len(u))
+	for sec, v := range u {
+		sections[sec] = maps.Clone(v)
 	}
-	if _, ok := unitConfig["Service"]; !ok {
-		unitConfig["Service"] = make(map[string]string)
+	return sections
+}
+
+func (u unitSections) set(section, name, value string) {
+	if _, ok := u[section]; !ok {
+		u[section] = make(map[string]string)
 	}
-	if _, ok := unitConfig["Service"]["WorkingDirectory"]; !ok {
-		unitConfig["Service"]["WorkingDirectory"] = filepath.Dir(path)
+	u[section][name] = value
+}
+
+func (u unitSections) setDefault(section, name, value string) {
+	if _, ok := u[section]; !ok {
+		u[section] = make(map[string]string)
+	}
+	if _, ok := u[section][name]; !ok {
+		u[section][name] = value
 	}
-	if _, ok := unitConfig["Service"]["PIDFile"]; !ok {
-		unitConfig["Service"]["PIDFile"] = "/run/" + binName + ".pid"
+}
+
+// applyPolicy adds the hardening preset and resource limits to the [Service] section
+func (u unitSections) applyPolicy(name string, spec *unitSpec) {
+	for k, v := range hardeningPresets[spec.hardening] {
+		if k == "RestrictAddressFamilies" && spec.network && !strings.Contains(v, "AF_INET") {
+			v += " AF_INET AF_INET6"
+		}
+		u.setDefault("Service", k, v)
 	}
-	if _, ok := unitConfig["Service"]["ExecStartPre"]; !ok {
-		unitConfig["Service"]["ExecStartPre"] = "/bin/rm -f /run/" + binName + ".pid"
+	for k, v := range spec.limits.options() {
+		u.setDefault("Service", k, v)
 	}
-	if _, ok := unitConfig["Service"]["ExecStart"]; !ok {
-		if multi {
-			unitConfig["Service"]["ExecStart"] = path + " --instance %i " + strings.Join(args, " ")
-		}else{
-			unitConfig["Service"]["ExecStart"] = path + " " + strings.Join(args, " ")
+	if u["Service"]["ProtectSystem"] == "strict" {
+		if dir, ok := u["Service"]["WorkingDirectory"]; ok {
+			u.setDefault("Service", "ReadWritePaths", "-"+dir)
 		}
+		u.setDefault("Service", "StateDirectory", name)
+		u.setDefault("Service", "LogsDirectory", name)
 	}
-	if _, ok := unitConfig["Service"]["ExecStartPost"]; !ok {
-		unitConfig["Service"]["ExecStartPost"] = "/bin/bash -c '/bin/systemctl show -p MainPID --value " + binName + " > /run/" + binName + ".pid'"
+}
+
+// unprivileged reports whether the service doesn't run as root
+func (u unitSections) unprivileged() bool {
+	_, ok := u["Service"]["User"]
+	return ok || isTrue(u["Service"]["DynamicUser"])
+}
+
+// CreateUnit renders the service unit of the default daemon
+func CreateUnit(multi bool, binName, desc, path string, args ...string) ([]byte, error) {
+	return Default().systemd.spec.createUnit(multi, binName, desc, path, args...)
+}
+
+func (spec *unitSpec) createUnit(multi bool, binName, desc, path string, args ...string) ([]byte, error) {
+	name := binName
+	if multi {
+		binName += "@%i"
+	}
+	// Work on a copy so that defaults derived from the arguments don't stick
+	sections := spec.config.clone()
+	sections.setDefault("Unit", "Description", strings.ToUpper(binName[:1])+binName[1:]+" "+desc)
+	sections.setDefault("Service", "WorkingDirectory", filepath.Dir(path))
+	sections.applyPolicy(name, spec)
+	// Pid file handling needs write access to /run, run it with full privileges
+	privileged := ""
+	if sections.unprivileged() {
+		privileged = "+"
+	}
+	runDir, systemctl := "/run/", "/bin/systemctl"
+	if spec.user {
+		// %t is the runtime directory of the user manager
+		runDir, systemctl = "%t/", "/bin/systemctl --user"
 	}
-	data := make([]*unit.UnitOption, 0, 10)
-	for sec, v := range unitConfig {
-		for name, value := range v {
-			data = append(data, &unit.UnitOption{Section: sec, Name: name, Value: value})
+	sections.setDefault("Service", "PIDFile", runDir+binName+".pid")
+	sections.setDefault("Service", "ExecStartPre", privileged+"/bin/rm -f "+runDir+binName+".pid")
+	if multi {
+		sections.setDefault("Service", "ExecStart", path+" --instance %i "+strings.Join(args, " "))
+	} else {
+		sections.setDefault("Service", "ExecStart", path+" "+strings.Join(args, " "))
+	}
+	sections.setDefault("Service", "ExecStartPost", privileged+"/bin/bash -c '"+systemctl+" show -p MainPID --value "+binName+" > "+runDir+binName+".pid'")
+	return serializeUnit(sections, spec.unitOptions()...)
+}
+
+// serializeUnit renders sections in a stable order so that generated units can be diffed.
+// Extra options, e.g. repeated keys, are written at the end of their section.
+func serializeUnit(sections unitSections, extra ...*unit.UnitOption) ([]byte, error) {
+	names := make([]string, 0, len(sections))
+	for sec := range sections {
+		names = append(names, sec)
+	}
+	for _, opt := range extra {
+		if _, ok := sections[opt.Section]; !ok && !slices.Contains(names, opt.Section) {
+			names = append(names, opt.Section)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		i, j := slices.Index(sectionOrder, a), slices.Index(sectionOrder, b)
+		switch {
+		case i >= 0 && j >= 0:
+			return i - j
+		case i >= 0:
+			return -1
+		case j >= 0:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	data := make([]*unit.UnitOption, 0, 16)
+	for _, sec := range names {
+		keys := make([]string, 0, len(sections[sec]))
+		for name := range sections[sec] {
+			keys = append(keys, name)
+		}
+		slices.Sort(keys)
+		for _, name := range keys {
+			data = append(data, &unit.UnitOption{Section: sec, Name: name, Value: sections[sec][name]})
+		}
+		for _, opt := range extra {
+			if opt.Section == sec {
+				data = append(data, opt)
+			}
 		}
 	}
-	reader := unit.Serialize(data)
-	buf := make([]byte, 1024)
-	n, err := reader.Read(buf)
-	if err != nil {
-		return nil, err
+	return io.ReadAll(unit.Serialize(data))
+}
+
+const unitStampPrefix = "# Generated by "
+
+// stampUnit prepends a header carrying the checksum of the unit body,
+// used later to detect local modifications of the installed file
+func stampUnit(name, version string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	header := fmt.Sprintf("%s%s %s, do not edit. sha256:%s\n", unitStampPrefix, name, version, hex.EncodeToString(sum[:]))
+	return append([]byte(header), body...)
+}
+
+// unitModified reports whether a stamped unit was edited after it was generated.
+// Units without a stamp are not managed by us and reported as unmodified.
+func unitModified(data []byte) bool {
+	header, body, ok := strings.Cut(string(data), "\n")
+	if !ok || !strings.HasPrefix(header, unitStampPrefix) {
+		return false
+	}
+	idx := strings.LastIndex(header, " sha256:")
+	if idx < 0 {
+		return false
 	}
-	return buf[:n], nil
+	sum := sha256.Sum256([]byte(body))
+	return header[idx+len(" sha256:"):] != hex.EncodeToString(sum[:])
 }
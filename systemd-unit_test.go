@@ -0,0 +1,256 @@
+package daemon
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestCreateUnitStable(t *testing.T) {
+	first, err := CreateUnit(true, "myservice", "MyTestService", "/usr/local/bin/myservice", "--debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		buf, err := CreateUnit(true, "myservice", "MyTestService", "/usr/local/bin/myservice", "--debug")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, buf) {
+			t.Fatalf("unit output is not stable:\n%s\n---\n%s", first, buf)
+		}
+	}
+	if !strings.HasPrefix(string(first), "[Unit]\n") {
+		t.Errorf("expected [Unit] first, got:\n%s", first)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(string(first)), "WantedBy=multi-user.target") {
+		t.Errorf("expected [Install] last, got:\n%s", first)
+	}
+}
+
+func TestUnitModified(t *testing.T) {
+	buf := stampUnit("myservice", "1.0.0", []byte("[Unit]\nDescription=x\n"))
+	if unitModified(buf) {
+		t.Error("fresh unit reported as modified")
+	}
+	if !unitModified(append(buf, "Wants=foo\n"...)) {
+		t.Error("edited unit not reported as modified")
+	}
+	if unitModified([]byte("[Unit]\nDescription=x\n")) {
+		t.Error("unstamped unit reported as modified")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	b := []byte("a\nb\nC\nd\ne\nf\ng\nh\ni\nj\nk\n")
+	if d := unifiedDiff("a", "b", a, a); d != "" {
+		t.Errorf("expected empty diff, got:\n%s", d)
+	}
+	want := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ a
+ b
+-c
++C
+ d
+ e
+ f
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if d := unifiedDiff("a", "b", a, b); d != want {
+		t.Errorf("unexpected diff:\n%s", d)
+	}
+	want = `--- a
++++ b
+@@ -0,0 +1,2 @@
++a
++b
+`
+	if d := unifiedDiff("a", "b", nil, []byte("a\nb\n")); d != want {
+		t.Errorf("unexpected diff:\n%s", d)
+	}
+}
+
+func TestValidateUnit(t *testing.T) {
+	buf, err := CreateUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateUnit(buf); err != nil {
+		t.Fatalf("default unit is invalid: %v", err)
+	}
+	for _, c := range []struct{ unit, want string }{
+		{"[Service]\nRestartSec=5 parsecs\n", "unknown time unit"},
+		{"[Service]\nRestartSec=soon\n", "invalid duration"},
+		{"[Service]\nRemainAfterExit=maybe\n", "invalid boolean"},
+		{"[Service]\nRestartPreventExitStatus=SIGKILLL\n", "unknown exit status"},
+		{"[Service]\nRestartPreventExitStatus=256\n", "out of range"},
+		{"[Service]\nExecStart=myservice --debug\n", "absolute path"},
+		{"[Service]\nExecStart=/nonexistent/myservice\n", "not found"},
+		{"[Service]\nMemoryMax=1X\n", "invalid size"},
+		{"[Foo]\nBar=1\n", "unknown section"},
+		{"[Service]\nRestrat=always\n", "unknown key"},
+	} {
+		err := ValidateUnit([]byte(c.unit))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: expected error containing %q, got %v", c.unit, c.want, err)
+		}
+	}
+	allowed := unitSections{"Foo": {}, "Service": {"NewerKey": ""}}
+	if err := validateUnit([]byte("[Foo]\nBar=1\n[Service]\nNewerKey=1\nLimitMEMLOCK=infinity\n"), allowed); err != nil {
+		t.Errorf("expected allowed options to be accepted, got %v", err)
+	}
+	for _, u := range []string{
+		"[Service]\nRestartSec=1min 30s\nRestartPreventExitStatus=1 SIGKILL SIGTERM\nX-Custom=1\n",
+		"[Service]\nExecStartPre=-/bin/rm -f /run/x.pid\nMemoryMax=512M\nCPUQuota=150%\nLimitNOFILE=1024:infinity\n",
+	} {
+		if err := ValidateUnit([]byte(u)); err != nil {
+			t.Errorf("%q: unexpected error %v", u, err)
+		}
+	}
+}
+
+func TestHardening(t *testing.T) {
+	defer SetHardening(HardeningNone)
+	if err := SetHardening("paranoid"); err == nil {
+		t.Error("expected error for unknown preset")
+	}
+	plain, err := CreateUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, preset := range HardeningPresets() {
+		if err := SetHardening(preset); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := CreateUnit(true, "myservice", "MyTestService", "/bin/sh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ValidateUnit(buf); err != nil {
+			t.Errorf("%s: invalid unit: %v", preset, err)
+		}
+		before, _ := ScoreUnit(plain)
+		after, _ := ScoreUnit(buf)
+		if after.Exposure >= before.Exposure {
+			t.Errorf("%s: exposure %.1f not lower than %.1f", preset, after.Exposure, before.Exposure)
+		}
+	}
+	buf, _ := CreateUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if !strings.Contains(string(buf), "ExecStartPre=+/bin/rm") {
+		t.Errorf("expected privileged ExecStartPre with DynamicUser:\n%s", buf)
+	}
+	report, _ := ScoreUnit(buf)
+	if report.Rating() != "OK" {
+		t.Errorf("expected OK rating for %s, got %.1f %s", Default().systemd.spec.hardening, report.Exposure, report.Rating())
+	}
+	spec := newUnitSpec()
+	spec.setHardening(HardeningStrict)
+	spec.network = true
+	buf, _ = spec.createUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if !strings.Contains(string(buf), "RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6\n") {
+		t.Errorf("expected IP sockets for the remote config with the strict preset:\n%s", buf)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addLimitFlags(fs)
+	fs.Parse([]string{"--memory-max", "1G", "--memory-high", "768M", "--cpu-quota", "150%", "--limit-nofile", "65536"})
+	l, err := limitsFromFlags(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"MemoryMax": "1G", "MemoryHigh": "768M", "CPUQuota": "150%", "LimitNOFILE": "65536"}
+	if got := l.options(); !maps.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if err := (Limits{MemoryMax: 1 << 20, MemoryHigh: 1 << 30}).Validate(); err == nil {
+		t.Error("expected error for MemoryHigh above MemoryMax")
+	}
+
+	defer SetLimits(Limits{})
+	if err := SetLimits(l); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := CreateUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateUnit(buf); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(buf), "\nCPUQuota=150%\n") {
+		t.Errorf("expected CPUQuota in unit:\n%s", buf)
+	}
+}
+
+func TestCreateTaskUnits(t *testing.T) {
+	tk := &task{
+		cmd:      &cobra.Command{Use: "cleanup"},
+		schedule: Schedule{OnCalendar: "daily", RandomizedDelaySec: "10min", Persistent: true},
+	}
+	service, timer, err := CreateTaskUnits("myservice", "MyTestService", "/bin/sh", tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range [][]byte{service, timer} {
+		if err = ValidateUnit(buf); err != nil {
+			t.Errorf("invalid unit: %v\n%s", err, buf)
+		}
+	}
+	for _, want := range []string{"Type=oneshot\n", "ExecStart=/bin/sh cleanup\n"} {
+		if !strings.Contains(string(service), want) {
+			t.Errorf("expected %q in service:\n%s", want, service)
+		}
+	}
+	for _, want := range []string{"OnCalendar=daily\n", "Persistent=yes\n", "RandomizedDelaySec=10min\n", "WantedBy=timers.target\n"} {
+		if !strings.Contains(string(timer), want) {
+			t.Errorf("expected %q in timer:\n%s", want, timer)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	d := newDaemon(viper.New())
+	spec := d.systemd.spec
+	spec.env, spec.envVar = "prod", "MYSERVICE_ENV"
+	if err := d.AddCredential(Credential{Name: "db"}); err == nil {
+		t.Error("expected error for credential without source")
+	}
+	d.AddCredential(Credential{Name: "db", Path: "/etc/myservice/db.pass"})
+	d.AddCredential(Credential{Name: "tls", Path: "/etc/myservice/tls.cred", Encrypted: true})
+	d.AddCredential(Credential{Name: "token", Data: "k6iUCUh0RJCQyvL8k8q1UyAAAAABAAAADAAAABAAAAC"})
+	buf, err := spec.createUnit(true, "myservice", "MyTestService", "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateUnit(buf); err != nil {
+		t.Error(err)
+	}
+	unit := string(buf)
+	for _, want := range []string{
+		"LoadCredential=db:/etc/myservice/db.pass\n",
+		"LoadCredentialEncrypted=tls:/etc/myservice/tls.cred\n",
+		"SetCredentialEncrypted=token: k6iUCUh0RJCQyvL8k8q1UyAAAAABAAAADAAAABAAAAC\n",
+		"Environment=MYSERVICE_ENV=prod\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("expected %q in unit:\n%s", want, unit)
+		}
+	}
+	if strings.Count(unit, "[Service]") != 1 {
+		t.Errorf("expected a single [Service] section:\n%s", unit)
+	}
+}
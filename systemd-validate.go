@@ -0,0 +1,478 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/coreos/go-systemd/v22/unit"
+)
+
+// UnitError describes an invalid option of a unit file
+type UnitError struct {
+	Section string
+	Name    string
+	Value   string
+	Err     error
+}
+
+func (e *UnitError) Error() string {
+	return fmt.Sprintf("[%s] %s=%s: %s", e.Section, e.Name, e.Value, e.Err)
+}
+
+func (e *UnitError) Unwrap() error { return e.Err }
+
+type unitCheck func(value string) error
+
+var unitKeys = map[string]map[string]unitCheck{
+	"Unit": {
+		"Description":           anyValue,
+		"Documentation":         anyValue,
+		"Wants":                 anyValue,
+		"Requires":              anyValue,
+		"Requisite":             anyValue,
+		"BindsTo":               anyValue,
+		"PartOf":                anyValue,
+		"Conflicts":             anyValue,
+		"Before":                anyValue,
+		"After":                 anyValue,
+		"OnFailure":             anyValue,
+		"OnSuccess":             anyValue,
+		"ConditionPathExists":   anyValue,
+		"AssertPathExists":      anyValue,
+		"DefaultDependencies":   isBool,
+		"RefuseManualStart":     isBool,
+		"RefuseManualStop":      isBool,
+		"StartLimitIntervalSec": isDuration,
+		"StartLimitBurst":       isUint,
+	},
+	"Service": {
+		"Type":                     oneOf("simple", "exec", "forking", "oneshot", "dbus", "notify", "notify-reload", "idle"),
+		"ExecStart":                isExec,
+		"ExecStartPre":             isExec,
+		"ExecStartPost":            isExec,
+		"ExecCondition":            isExec,
+		"ExecReload":               isExec,
+		"ExecStop":                 isExec,
+		"ExecStopPost":             isExec,
+		"Restart":                  oneOf("no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always"),
+		"RestartSec":               isDuration,
+		"RestartPreventExitStatus": isExitStatus,
+		"RestartForceExitStatus":   isExitStatus,
+		"SuccessExitStatus":        isExitStatus,
+		"StartLimitInterval":       isDuration,
+		"StartLimitBurst":          isUint,
+		"TimeoutSec":               isDuration,
+		"TimeoutStartSec":          isDuration,
+		"TimeoutStopSec":           isDuration,
+		"RuntimeMaxSec":            isDuration,
+		"WatchdogSec":              isDuration,
+		"RemainAfterExit":          isBool,
+		"PIDFile":                  isAbsPath,
+		"WorkingDirectory":         isWorkingDirectory,
+		"RootDirectory":            isAbsPath,
+		"User":                     anyValue,
+		"Group":                    anyValue,
+		"SupplementaryGroups":      anyValue,
+		"DynamicUser":              isBool,
+		"Environment":              anyValue,
+		"EnvironmentFile":          anyValue,
+		"PassEnvironment":          anyValue,
+		"StandardInput":            anyValue,
+		"StandardOutput":           anyValue,
+		"StandardError":            anyValue,
+		"SyslogIdentifier":         anyValue,
+		"KillMode":                 oneOf("control-group", "mixed", "process", "none"),
+		"KillSignal":               isSignal,
+		"RestartKillSignal":        isSignal,
+		"FinalKillSignal":          isSignal,
+		"SendSIGKILL":              isBool,
+		"SendSIGHUP":               isBool,
+		"NotifyAccess":             oneOf("none", "main", "exec", "all"),
+		"Nice":                     isRange(-20, 19),
+		"UMask":                    isOctal,
+		"Slice":                    anyValue,
+		"Delegate":                 anyValue,
+		// Resource control
+		"MemoryMin":                isSize,
+		"MemoryLow":                isSize,
+		"MemoryHigh":               isSize,
+		"MemoryMax":                isSize,
+		"MemorySwapMax":            isSize,
+		"CPUQuota":                 isPercent,
+		"CPUWeight":                isRange(1, 10000),
+		"TasksMax":                 isTasks,
+		"IOWeight":                 isRange(1, 10000),
+		"LimitNOFILE":              isLimit,
+		"LimitNPROC":               isLimit,
+		"LimitCORE":                isLimit,
+		"LimitMEMLOCK":             isLimit,
+		"LimitAS":                  isLimit,
+		"LimitDATA":                isLimit,
+		"LimitFSIZE":               isLimit,
+		"LimitSTACK":               isLimit,
+		"LimitRSS":                 isLimit,
+		"LimitNICE":                isLimit,
+		"LimitRTPRIO":              isLimit,
+		"LimitRTTIME":              isLimit,
+		"LimitSIGPENDING":          isLimit,
+		"LimitMSGQUEUE":            isLimit,
+		"LimitLOCKS":               isLimit,
+		"OOMScoreAdjust":           isRange(-1000, 1000),
+		"OOMPolicy":                oneOf("continue", "stop", "kill"),
+		"CPUAffinity":              anyValue,
+		"CPUSchedulingPolicy":      oneOf("other", "batch", "idle", "fifo", "rr"),
+		"CPUSchedulingPriority":    isRange(0, 99),
+		"IOSchedulingClass":        anyValue,
+		"IOSchedulingPriority":     isRange(0, 7),
+		"AllowedCPUs":              anyValue,
+		"ManagedOOMSwap":           oneOf("auto", "kill"),
+		"ManagedOOMMemoryPressure": oneOf("auto", "kill"),
+		// Sandboxing
+		"ProtectSystem":           boolOr("strict", "full"),
+		"ProtectHome":             boolOr("read-only", "tmpfs"),
+		"ProtectProc":             oneOf("noaccess", "invisible", "ptraceable", "default"),
+		"ProcSubset":              oneOf("all", "pid"),
+		"PrivateTmp":              isBool,
+		"PrivateDevices":          isBool,
+		"PrivateNetwork":          isBool,
+		"PrivateUsers":            isBool,
+		"NoNewPrivileges":         isBool,
+		"ProtectKernelTunables":   isBool,
+		"ProtectKernelModules":    isBool,
+		"ProtectKernelLogs":       isBool,
+		"ProtectControlGroups":    isBool,
+		"ProtectClock":            isBool,
+		"ProtectHostname":         isBool,
+		"RestrictRealtime":        isBool,
+		"RestrictSUIDSGID":        isBool,
+		"LockPersonality":         isBool,
+		"MemoryDenyWriteExecute":  isBool,
+		"RemoveIPC":               isBool,
+		"RestrictNamespaces":      anyValue,
+		"CapabilityBoundingSet":   anyValue,
+		"AmbientCapabilities":     anyValue,
+		"SystemCallFilter":        anyValue,
+		"SystemCallArchitectures": anyValue,
+		"SystemCallErrorNumber":   anyValue,
+		"RestrictAddressFamilies": anyValue,
+		"IPAddressAllow":          anyValue,
+		"IPAddressDeny":           anyValue,
+		"ReadWritePaths":          anyValue,
+		"ReadOnlyPaths":           anyValue,
+		"InaccessiblePaths":       anyValue,
+		"RuntimeDirectory":        anyValue,
+		"StateDirectory":          anyValue,
+		"CacheDirectory":          anyValue,
+		"LogsDirectory":           anyValue,
+		"ConfigurationDirectory":  anyValue,
+		// Credentials
+		"LoadCredential":          anyValue,
+		"LoadCredentialEncrypted": anyValue,
+		"SetCredential":           anyValue,
+		"SetCredentialEncrypted":  anyValue,
+	},
+	"Timer": {
+		"OnActiveSec":        isDuration,
+		"OnBootSec":          isDuration,
+		"OnStartupSec":       isDuration,
+		"OnUnitActiveSec":    isDuration,
+		"OnUnitInactiveSec":  isDuration,
+		"OnCalendar":         anyValue,
+		"AccuracySec":        isDuration,
+		"RandomizedDelaySec": isDuration,
+		"FixedRandomDelay":   isBool,
+		"Persistent":         isBool,
+		"WakeSystem":         isBool,
+		"RemainAfterElapse":  isBool,
+		"Unit":               anyValue,
+	},
+	"Install": {
+		"WantedBy":        anyValue,
+		"RequiredBy":      anyValue,
+		"Alias":           anyValue,
+		"Also":            anyValue,
+		"DefaultInstance": anyValue,
+	},
+}
+
+// ValidateUnit checks a unit file for unknown sections and keys and malformed values,
+// returning all problems found joined together. Keys prefixed with X- are not checked.
+func ValidateUnit(buf []byte) error { return validateUnit(buf, nil) }
+
+// validateUnit is ValidateUnit accepting the unknown options in allowed, where a section
+// without keys allows all of its keys
+func validateUnit(buf []byte, allowed unitSections) error {
+	opts, err := unit.DeserializeOptions(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, opt := range opts {
+		if keys, ok := allowed[opt.Section]; ok {
+			if _, ok = keys[opt.Name]; ok || len(keys) == 0 {
+				continue
+			}
+		}
+		keys, ok := unitKeys[opt.Section]
+		if !ok {
+			errs = append(errs, &UnitError{opt.Section, opt.Name, opt.Value, errors.New("unknown section")})
+			continue
+		}
+		if strings.HasPrefix(opt.Name, "X-") {
+			continue
+		}
+		check, ok := keys[opt.Name]
+		if !ok {
+			errs = append(errs, &UnitError{opt.Section, opt.Name, opt.Value, errors.New("unknown key")})
+			continue
+		}
+		if err := check(opt.Value); err != nil {
+			errs = append(errs, &UnitError{opt.Section, opt.Name, opt.Value, err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func anyValue(string) error { return nil }
+
+func isBool(v string) error {
+	switch strings.ToLower(v) {
+	case "1", "yes", "y", "true", "t", "on", "0", "no", "n", "false", "f", "off":
+		return nil
+	}
+	return errors.New("invalid boolean")
+}
+
+// isTrue reports whether v is a systemd boolean that is set
+func isTrue(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "yes", "y", "true", "t", "on":
+		return true
+	}
+	return false
+}
+
+func boolOr(values ...string) unitCheck {
+	return func(v string) error {
+		if isBool(v) == nil || slices.Contains(values, v) {
+			return nil
+		}
+		return fmt.Errorf("expected a boolean or one of %s", strings.Join(values, ", "))
+	}
+}
+
+func oneOf(values ...string) unitCheck {
+	return func(v string) error {
+		if slices.Contains(values, v) {
+			return nil
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(values, ", "))
+	}
+}
+
+func isUint(v string) error {
+	if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+		return errors.New("invalid unsigned integer")
+	}
+	return nil
+}
+
+func isRange(lo, hi int) unitCheck {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi {
+			return fmt.Errorf("expected an integer between %d and %d", lo, hi)
+		}
+		return nil
+	}
+}
+
+func isOctal(v string) error {
+	if _, err := strconv.ParseUint(v, 8, 32); err != nil {
+		return errors.New("invalid octal mode")
+	}
+	return nil
+}
+
+var timeUnits = []string{
+	"usec", "us", "µs", "msec", "ms", "seconds", "second", "sec", "s",
+	"minutes", "minute", "min", "m", "hours", "hour", "hr", "h",
+	"days", "day", "d", "weeks", "week", "w", "months", "month", "M", "years", "year", "y",
+}
+
+// isDuration accepts systemd time spans such as "30", "5s", "1min 30s" or "infinity"
+func isDuration(v string) error {
+	v = strings.TrimSpace(v)
+	if v == "infinity" {
+		return nil
+	}
+	if v == "" {
+		return errors.New("empty duration")
+	}
+	for rest := v; rest != ""; {
+		num := strings.TrimLeftFunc(rest, func(r rune) bool { return unicode.IsDigit(r) || r == '.' })
+		if len(num) == len(rest) {
+			return errors.New("invalid duration")
+		}
+		if _, err := strconv.ParseFloat(rest[:len(rest)-len(num)], 64); err != nil {
+			return errors.New("invalid duration")
+		}
+		num = strings.TrimLeft(num, " ")
+		tail := strings.TrimLeftFunc(num, unicode.IsLetter)
+		if u := num[:len(num)-len(tail)]; u != "" && !slices.Contains(timeUnits, u) {
+			return fmt.Errorf("unknown time unit %q", u)
+		}
+		rest = strings.TrimLeft(tail, " ")
+	}
+	return nil
+}
+
+// isSize accepts byte sizes with an optional K, M, G, T, P or E suffix, percentages and "infinity"
+func isSize(v string) error {
+	if v == "infinity" || isPercent(v) == nil {
+		return nil
+	}
+	if _, err := parseSize(v); err != nil {
+		return err
+	}
+	return nil
+}
+
+const sizeSuffixes = "KMGTPE"
+
+func parseSize(v string) (uint64, error) {
+	shift := 0
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte(sizeSuffixes, v[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || (shift > 0 && n > (1<<(64-shift))-1) {
+		return 0, errors.New("invalid size")
+	}
+	return n << shift, nil
+}
+
+func isPercent(v string) error {
+	n, ok := strings.CutSuffix(v, "%")
+	if !ok {
+		return errors.New("expected a percentage")
+	}
+	if f, err := strconv.ParseFloat(n, 64); err != nil || f < 0 {
+		return errors.New("invalid percentage")
+	}
+	return nil
+}
+
+func isTasks(v string) error {
+	if v == "infinity" || isUint(v) == nil || isPercent(v) == nil {
+		return nil
+	}
+	return errors.New("expected a number, a percentage or infinity")
+}
+
+// isLimit accepts resource limits as "value" or "soft:hard"
+func isLimit(v string) error {
+	for _, p := range strings.SplitN(v, ":", 2) {
+		if p == "infinity" {
+			continue
+		}
+		if _, err := parseSize(p); err != nil {
+			return errors.New("expected a number, infinity or soft:hard")
+		}
+	}
+	return nil
+}
+
+var signalNames = []string{
+	"HUP", "INT", "QUIT", "ILL", "TRAP", "ABRT", "BUS", "FPE", "KILL", "USR1", "SEGV", "USR2",
+	"PIPE", "ALRM", "TERM", "STKFLT", "CHLD", "CONT", "STOP", "TSTP", "TTIN", "TTOU", "URG",
+	"XCPU", "XFSZ", "VTALRM", "PROF", "WINCH", "IO", "PWR", "SYS",
+}
+
+var exitStatusNames = []string{
+	"SUCCESS", "FAILURE", "INVALIDARGUMENT", "NOTIMPLEMENTED",
+	"NOPERMISSION", "NOTINSTALLED", "NOTCONFIGURED", "NOTRUNNING",
+}
+
+func isSignal(v string) error {
+	name := strings.TrimPrefix(v, "SIG")
+	if slices.Contains(signalNames, name) {
+		return nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 && n < 65 {
+		return nil
+	}
+	return fmt.Errorf("unknown signal %q", v)
+}
+
+// isExitStatus accepts a space separated list of exit codes and signal names
+func isExitStatus(v string) error {
+	for _, f := range strings.Fields(v) {
+		if n, err := strconv.Atoi(f); err == nil {
+			if n < 0 || n > 255 {
+				return fmt.Errorf("exit status %d out of range", n)
+			}
+			continue
+		}
+		if slices.Contains(exitStatusNames, f) {
+			continue
+		}
+		if strings.HasPrefix(f, "SIG") && isSignal(f) == nil {
+			continue
+		}
+		return fmt.Errorf("unknown exit status or signal %q", f)
+	}
+	return nil
+}
+
+func isAbsPath(v string) error {
+	// Specifiers like %t and %h expand to absolute directories
+	if len(v) > 2 && v[0] == '%' && strings.ContainsRune("hCELStT", rune(v[1])) && v[2] == '/' {
+		return nil
+	}
+	if !filepath.IsAbs(v) {
+		return errors.New("path must be absolute")
+	}
+	return nil
+}
+
+func isWorkingDirectory(v string) error {
+	if v == "~" {
+		return nil
+	}
+	return isAbsPath(strings.TrimPrefix(v, "-"))
+}
+
+// isExec checks that the command of an Exec line is an absolute path to an executable
+func isExec(v string) error {
+	cmd := strings.TrimLeft(strings.TrimSpace(v), "@-:+!")
+	if cmd == "" {
+		return errors.New("empty command")
+	}
+	path, _, _ := strings.Cut(cmd, " ")
+	path = strings.Trim(path, `"'`)
+	if err := isAbsPath(path); err != nil {
+		return fmt.Errorf("command %q must be an absolute path", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("binary %s not found", path)
+		}
+		return err
+	}
+	if fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
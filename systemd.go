@@ -1,12 +1,19 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	stderrors "errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 
 	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 )
 
 type Systemd struct {
@@ -15,27 +22,291 @@ type Systemd struct {
 	Description string
 	Version     string
 	AppID       string
+	spec        *unitSpec
+	// args are passed to the service before the install arguments, e.g. --component
+	args       []string
+	components []*Component
+	// hooks runs the install and remove hooks of the daemon, loadHooks loads the config
+	// they read
+	hooks     func(cmd *cobra.Command, p Phase) error
+	loadHooks func(cmd *cobra.Command, phases ...Phase) error
 }
 
-func (s *Systemd) Install(multi bool, args ...string) error {
-	s.logger.Info("Install... " + s.Name)
+// component returns the Systemd managing the unit of a component, <name>-<component>@.service.
+// Tasks belong to the daemon and are not managed by the components.
+func (s *Systemd) component(c *Component) *Systemd {
+	spec := *s.spec
+	spec.tasks = nil
+	t := &Systemd{
+		logger:      s.logger,
+		Name:        s.Name + "-" + c.Name,
+		Description: s.Description,
+		Version:     s.Version,
+		AppID:       s.AppID,
+		spec:        &spec,
+		args:        []string{"--component", c.Name},
+		hooks:       s.hooks,
+		loadHooks:   s.loadHooks,
+	}
+	if c.Description != "" {
+		t.Description = c.Description
+	}
+	return t
+}
+
+// services returns the Systemd of every component, or s itself without components
+func (s *Systemd) services() []*Systemd {
+	if len(s.components) == 0 {
+		return []*Systemd{s}
+	}
+	items := make([]*Systemd, 0, len(s.components))
+	for _, c := range s.components {
+		items = append(items, s.component(c))
+	}
+	return items
+}
+
+// target returns the Systemd of the component selected by --component, or s itself
+func (s *Systemd) target(cmd *cobra.Command) (*Systemd, error) {
+	f := cmd.Flags().Lookup("component")
+	if f == nil || f.Value.String() == "" {
+		return s, nil
+	}
+	for _, c := range s.components {
+		if c.Name == f.Value.String() {
+			return s.component(c), nil
+		}
+	}
+	return nil, errors.Errorf("unknown component %q", f.Value.String())
+}
+
+// targets returns the Systemd of the component selected by --component, or those of all services
+func (s *Systemd) targets(cmd *cobra.Command) ([]*Systemd, error) {
+	t, err := s.target(cmd)
+	if err != nil || t != s {
+		return []*Systemd{t}, err
+	}
+	return s.services(), nil
+}
+
+// InstallOptions controls how Install writes the unit file
+type InstallOptions struct {
+	Multi  bool // Use template unit service
+	DryRun bool // Print the unit instead of writing it
+	Diff   bool // Print a unified diff against the installed unit instead of writing it
+	Force  bool // Overwrite the installed unit even if it was modified locally
+}
+
+const systemUnitDir = "/etc/systemd/system/"
+
+// unitDir is where units are installed, the unit directory of the user in user mode
+func (s *Systemd) unitDir() (string, error) {
+	if !s.spec.user {
+		return systemUnitDir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "user unit directory")
+	}
+	return filepath.Join(dir, "systemd", "user") + "/", nil
+}
+
+// installed reports whether a unit of the service is installed
+func (s *Systemd) installed() bool {
+	for _, t := range s.services() {
+		if fn, err := t.unitPath(); err == nil {
+			if _, err = os.Stat(fn); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareHooks loads the config of the hooks of the phases, if the daemon has any
+func (s *Systemd) prepareHooks(cmd *cobra.Command, phases ...Phase) error {
+	if s.loadHooks == nil {
+		return nil
+	}
+	return s.loadHooks(cmd, phases...)
+}
+
+// runHooks runs the hooks of the phase, if the daemon has any
+func (s *Systemd) runHooks(cmd *cobra.Command, p Phase) error {
+	if s.hooks == nil {
+		return nil
+	}
+	return s.hooks(cmd, p)
+}
+
+func (s *Systemd) unitPath() (string, error) {
+	dir, err := s.unitDir()
+	return dir + s.Name + "@.service", err
+}
+
+// connect connects to the system manager, or to the manager of the user in user mode
+func (s *Systemd) connect(ctx context.Context) (*systemd.Conn, error) {
+	if s.spec.user {
+		return systemd.NewUserConnectionContext(ctx)
+	}
+	return systemd.NewSystemConnectionContext(ctx)
+}
+
+func (s *Systemd) Install(opts InstallOptions, args ...string) error {
 	execPath, err := os.Executable()
 	if err != nil {
 		return err
 	}
-	var buf []byte
-	buf, err = CreateUnit(multi, s.Name, s.Description, execPath, args...)
+	dir, err := s.unitDir()
 	if err != nil {
 		return err
 	}
-	os.WriteFile("/etc/systemd/system/"+s.Name+"@.service", buf, 0644)
+	files := make(map[string][]byte)
+	paths := make([]string, 0, 1+len(s.components)+2*len(s.spec.tasks))
+	for _, t := range s.services() {
+		buf, err := t.spec.createUnit(opts.Multi, t.Name, t.Description, execPath, append(slices.Clone(t.args), args...)...)
+		if err != nil {
+			return err
+		}
+		fn := dir + t.Name + "@.service"
+		files[fn] = buf
+		paths = append(paths, fn)
+	}
+	timers := make([]string, 0, len(s.spec.tasks))
+	for _, t := range s.spec.tasks {
+		service, timer, err := s.spec.createTaskUnits(s.Name, s.Description, execPath, t)
+		if err != nil {
+			return err
+		}
+		name := s.taskUnitName(t)
+		files[dir+name+".service"] = service
+		files[dir+name+".timer"] = timer
+		paths = append(paths, dir+name+".service", dir+name+".timer")
+		timers = append(timers, name+".timer")
+	}
+	for _, fn := range paths {
+		if err = s.checkUnit(fn, files[fn]); err != nil {
+			return err
+		}
+	}
+	preview := opts.DryRun || opts.Diff
+	if !preview {
+		s.logger.Info("Install... " + s.Name)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	for _, fn := range paths {
+		if err = s.writeUnit(fn, files[fn], opts); err != nil {
+			return err
+		}
+	}
+	if preview {
+		return nil
+	}
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
+	if err = conn.ReloadContext(ctx); err != nil {
+		return err
+	}
+	if len(timers) > 0 {
+		if _, _, err = conn.EnableUnitFilesContext(ctx, timers, false, true); err != nil {
+			return err
+		}
+		recv := make(chan string, 1)
+		for _, name := range timers {
+			if _, err = conn.StartUnitContext(ctx, name, "replace", recv); err != nil {
+				s.logger.Warn(err.Error())
+				continue
+			}
+			s.logger.Info("Started [ " + name + " ] " + <-recv)
+		}
+	}
 	s.logger.Info("Installed " + s.Name)
-	return conn.ReloadContext(ctx)
+	return nil
+}
+
+// checkUnit rejects a malformed unit or one with options neither known nor allowed
+func (s *Systemd) checkUnit(fn string, buf []byte) error {
+	if err := validateUnit(buf, s.spec.allowed); err != nil {
+		return errors.Wrapf(err, "invalid unit %s", fn)
+	}
+	return nil
+}
+
+// writeUnit stamps and writes a unit file, keeping a backup of the previous one
+func (s *Systemd) writeUnit(fn string, buf []byte, opts InstallOptions) error {
+	buf = stampUnit(s.Name, s.Version, buf)
+	old, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if opts.DryRun {
+		fmt.Print("# " + fn + "\n" + string(buf) + "\n")
+	}
+	if opts.Diff {
+		fmt.Print(unifiedDiff(fn, fn+".new", old, buf))
+	}
+	if opts.DryRun || opts.Diff {
+		return nil
+	}
+	if old != nil {
+		if bytes.Equal(old, buf) {
+			s.logger.Info("Unit is up to date " + fn)
+			return nil
+		}
+		if unitModified(old) {
+			if !opts.Force {
+				return errors.Errorf("%s has local modifications, use --diff to review and --force to overwrite", fn)
+			}
+			s.logger.Warn("Overwriting locally modified unit " + fn)
+		}
+		if err = os.WriteFile(fn+".bak", old, 0644); err != nil {
+			return errors.Wrap(err, "backup unit")
+		}
+		s.logger.Info("Backup saved to " + fn + ".bak")
+	}
+	if err = writeFileAtomic(fn, buf, 0644); err != nil {
+		return errors.Wrap(err, "write unit")
+	}
+	return nil
+}
+
+// Security scores the sandboxing of the installed unit
+func (s *Systemd) Security() (*SecurityReport, error) {
+	fn, err := s.unitPath()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return ScoreUnit(buf)
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it into place
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
 }
 
 // Remove the service
@@ -45,8 +316,20 @@ func (s *Systemd) Remove() error {
 	if err != nil {
 		s.logger.Warn(err.Error())
 	}
-	err = os.Remove("/etc/systemd/system/" + s.Name + "@.service")
-	if err != nil {
+	if err = s.removeTasks(); err != nil {
+		s.logger.Warn(err.Error())
+	}
+	var errs []error
+	for _, t := range s.services() {
+		fn, err := t.unitPath()
+		if err == nil {
+			err = os.Remove(fn)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err = stderrors.Join(errs...); err != nil {
 		return err
 	}
 	s.logger.Info("Removed " + s.Name)
@@ -56,7 +339,7 @@ func (s *Systemd) Remove() error {
 // Start the service
 func (s *Systemd) Start(num int, tags ...string) error {
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -110,7 +393,7 @@ func (s *Systemd) Start(num int, tags ...string) error {
 // Stop the service
 func (s *Systemd) Stop(all bool, tags ...string) error {
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -169,7 +452,7 @@ func (s *Systemd) Stop(all bool, tags ...string) error {
 // Kill the service
 func (s *Systemd) Kill(all bool, tags ...string) error {
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -194,7 +477,7 @@ func (s *Systemd) Kill(all bool, tags ...string) error {
 // Restart the service
 func (s *Systemd) Restart(all bool, tags ...string) error {
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -254,7 +537,7 @@ func (s *Systemd) Restart(all bool, tags ...string) error {
 func (s *Systemd) Reload(all bool, tags ...string) error {
 	s.logger.Info("Reloading... " + s.Name)
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -311,11 +594,11 @@ func (s *Systemd) Reload(all bool, tags ...string) error {
 // Status - Get service status
 func (s *Systemd) Status(show bool) ([]systemd.UnitStatus, error) {
 	ctx := context.Background()
-	conn, err := systemd.NewSystemConnectionContext(ctx)
+	conn, err := s.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	items, err := conn.ListUnitsByPatternsContext(ctx, nil, []string{s.Name + "*"})
+	items, err := conn.ListUnitsByPatternsContext(ctx, nil, []string{s.Name + "@*.service", s.Name + ".service"})
 	if err != nil {
 		return nil, err
 	}